@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/crossplane/function-keycloak/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// membershipChange is how the users written to a path differ from the ones
+// the XR holds there.
+type membershipChange struct {
+	Added     []string
+	Removed   []string
+	Unchanged int
+}
+
+// diffMembers compares the users about to be written with the observed ones.
+// Users are matched the same way the guardrails match them, ignoring the case
+// of emails when ignoreEmailCase is set.
+func diffMembers(observed, output []any, ignoreEmailCase bool) membershipChange {
+	before := make(map[string]bool, len(observed))
+	for _, v := range observed {
+		before[dedupeKey(v, ignoreEmailCase)] = true
+	}
+	after := make(map[string]bool, len(output))
+	c := membershipChange{}
+	for _, v := range output {
+		key := dedupeKey(v, ignoreEmailCase)
+		if after[key] {
+			continue
+		}
+		after[key] = true
+		if before[key] {
+			c.Unchanged++
+		} else {
+			c.Added = append(c.Added, memberLabel(v))
+		}
+	}
+	for _, v := range observed {
+		if key := dedupeKey(v, ignoreEmailCase); !after[key] {
+			after[key] = true
+			c.Removed = append(c.Removed, memberLabel(v))
+		}
+	}
+	return c
+}
+
+// memberLabel names a written user in results: the string itself, or the
+// username, email or id of a user object.
+func memberLabel(v any) string {
+	if obj, ok := v.(map[string]any); ok {
+		for _, f := range []v1beta1.UserField{v1beta1.UserFieldUsername, v1beta1.UserFieldEmail, v1beta1.UserFieldID} {
+			if s, ok := obj[string(f)].(string); ok && s != "" {
+				return s
+			}
+		}
+	}
+	return memberKey(v)
+}
+
+// reportChanges emits a Normal result for the users added to and one for the
+// users removed from path.
+func reportChanges(rsp *fnv1.RunFunctionResponse, path string, c membershipChange, cr *v1beta1.ChangeReport) {
+	limit := maxListed(cr)
+	if len(c.Added) > 0 {
+		response.Normalf(rsp, "Added %d users to %s%s", len(c.Added), path, listUsers(c.Added, limit))
+	}
+	if len(c.Removed) > 0 {
+		response.Normalf(rsp, "Removed %d users from %s%s", len(c.Removed), path, listUsers(c.Removed, limit))
+	}
+}
+
+// maxListed is how many users a result names.
+func maxListed(cr *v1beta1.ChangeReport) int {
+	if cr != nil && cr.MaxListed != nil {
+		return *cr.MaxListed
+	}
+	return v1beta1.DefaultChangeReportMaxListed
+}
+
+// listUsers names up to maxListed users for the end of a result, or nothing
+// when maxListed is zero or less.
+func listUsers(users []string, maxListed int) string {
+	switch {
+	case maxListed <= 0 || len(users) == 0:
+		return ""
+	case len(users) <= maxListed:
+		return ": " + strings.Join(users, ", ")
+	}
+	return fmt.Sprintf(": %s and %d more", strings.Join(users[:maxListed], ", "), len(users)-maxListed)
+}
+
+// changeSummaryPath is where the summary of path is kept in the object at
+// summaryField.
+func changeSummaryPath(summaryField, path string) string {
+	return fmt.Sprintf("%s[%s]", summaryField, path)
+}
+
+// changeSummary returns the summary written for a change. lastChanged is
+// carried over from the observed summary when nothing changed.
+func changeSummary(xr *fieldpath.Paved, summaryPath string, c membershipChange, now time.Time) map[string]any {
+	summary := map[string]any{
+		"added":     int64(len(c.Added)),
+		"removed":   int64(len(c.Removed)),
+		"unchanged": int64(c.Unchanged),
+	}
+	if len(c.Added) > 0 || len(c.Removed) > 0 {
+		summary["lastChanged"] = now.UTC().Format(time.RFC3339)
+	} else if last, err := xr.GetString(summaryPath + ".lastChanged"); err == nil {
+		summary["lastChanged"] = last
+	}
+	return summary
+}
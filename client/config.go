@@ -0,0 +1,66 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+)
+
+// Environment variables used as the fallback connection settings.
+const (
+	EnvClientId     = "KEYCLOAK_CLIENT_ID"
+	EnvClientSecret = "KEYCLOAK_CLIENT_SECRET"
+	EnvRealm        = "KEYCLOAK_REALM"
+	EnvUrl          = "KEYCLOAK_URL"
+)
+
+// Keys read from the credential data passed in a RunFunctionRequest.
+const (
+	CredentialKeyClientId     = "clientId"
+	CredentialKeyClientSecret = "clientSecret"
+	CredentialKeyRealm        = "realm"
+	CredentialKeyUrl          = "url"
+)
+
+// Config holds the settings needed to talk to a Keycloak instance.
+type Config struct {
+	ClientId     string `json:"clientId,omitempty"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	Realm        string `json:"realm,omitempty"`
+	Url          string `json:"url,omitempty"`
+}
+
+// ConfigFromEnv reads the connection settings from the process environment.
+func ConfigFromEnv() Config {
+	return Config{
+		ClientId:     os.Getenv(EnvClientId),
+		ClientSecret: os.Getenv(EnvClientSecret),
+		Realm:        os.Getenv(EnvRealm),
+		Url:          os.Getenv(EnvUrl),
+	}
+}
+
+// WithCredentials returns a copy of the config where every setting present in
+// the credential data replaces the current value.
+func (c Config) WithCredentials(data map[string][]byte) Config {
+	if v, ok := data[CredentialKeyClientId]; ok && len(v) > 0 {
+		c.ClientId = string(v)
+	}
+	if v, ok := data[CredentialKeyClientSecret]; ok && len(v) > 0 {
+		c.ClientSecret = string(v)
+	}
+	if v, ok := data[CredentialKeyRealm]; ok && len(v) > 0 {
+		c.Realm = string(v)
+	}
+	if v, ok := data[CredentialKeyUrl]; ok && len(v) > 0 {
+		c.Url = string(v)
+	}
+	return c
+}
+
+// key identifies the Keycloak instance and client a config logs in as, and
+// the secret it logs in with, hashed to keep it out of the pool keys.
+func (c Config) key() string {
+	secret := sha256.Sum256([]byte(c.ClientSecret))
+	return c.Url + "|" + c.Realm + "|" + c.ClientId + "|" + hex.EncodeToString(secret[:])
+}
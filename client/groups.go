@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+	"github.com/go-resty/resty/v2"
+	"github.com/samber/lo"
+)
+
+var groupIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// resolveGroup finds the group a reference points at. References starting
+// with "/" are full group paths, UUIDs are group IDs and anything else is the
+// name of a top-level group. A missing group resolves to nil.
+func (k *KeycloakClient) resolveGroup(ctx context.Context, realm, ref string) (*gocloak.Group, error) {
+	key := k.cacheKey(realm, "group-ref", ref)
+	return load(ctx, k, k.cacheGroup, key, defaultCacheExpiration, func(ctx context.Context) (*gocloak.Group, error) {
+		var (
+			group *gocloak.Group
+			err   error
+		)
+		switch {
+		case strings.HasPrefix(ref, "/"):
+			err = k.call(ctx, func(ctx context.Context, token string) (err error) {
+				group, err = k.keycloakClient.GetGroupByPath(ctx, token, realm, strings.TrimPrefix(ref, "/"))
+				return err
+			})
+		case groupIDPattern.MatchString(ref):
+			err = k.call(ctx, func(ctx context.Context, token string) (err error) {
+				group, err = k.keycloakClient.GetGroup(ctx, token, realm, ref)
+				return err
+			})
+		default:
+			group, err = k.topLevelGroup(ctx, realm, ref)
+		}
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return group, err
+	})
+}
+
+// topLevelGroup returns the top-level group with the supplied name. Keycloak's
+// exact name search finds it without listing every group of the realm.
+func (k *KeycloakClient) topLevelGroup(ctx context.Context, realm, name string) (*gocloak.Group, error) {
+	key := k.cacheKey(realm, "group-name", name)
+	found, err := load(ctx, k, k.cacheGroups, key, defaultCacheExpiration, func(ctx context.Context) (listing[*gocloak.Group], error) {
+		return listAll(k.pageSize, k.maxResults, func(first, max int) (page []*gocloak.Group, err error) {
+			err = k.call(ctx, func(ctx context.Context, token string) error {
+				page, err = k.keycloakClient.GetGroups(ctx, token, realm, gocloak.GetGroupsParams{
+					Search: gocloak.StringP(name),
+					Exact:  gocloak.BoolP(true),
+					First:  gocloak.IntP(first),
+					Max:    gocloak.IntP(max),
+				})
+				return err
+			})
+			return page, err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Search results also hold the top-level ancestors of nested matches,
+	// with only the subgroups leading to them inlined, so the subgroups are
+	// dropped to have descendants read all of them.
+	if group, ok := lo.Find(found.Items, func(g *gocloak.Group) bool { return gocloak.PString(g.Name) == name }); ok {
+		top := *group
+		top.SubGroups = nil
+		return &top, nil
+	}
+	if found.Truncated {
+		return nil, fmt.Errorf("group %s not found in the first %d search results of realm %s, reference it by path or ID", name, k.maxResults, realm)
+	}
+	return nil, nil
+}
+
+// descendants returns every group below the supplied one, parents first,
+// along with warnings for children listings cut off by the result cap.
+func (k *KeycloakClient) descendants(ctx context.Context, realm string, group *gocloak.Group) ([]*gocloak.Group, []string, error) {
+	result := []*gocloak.Group{}
+	warnings := []string{}
+	visited := map[string]bool{gocloak.PString(group.ID): true}
+	queue := []*gocloak.Group{group}
+	for len(queue) > 0 {
+		children, err := k.subGroups(ctx, realm, queue[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		if children.Truncated {
+			warnings = append(warnings, fmt.Sprintf("group %s has more than %d subgroups, only the first %d are included", groupLabel(queue[0]), k.maxResults, k.maxResults))
+		}
+		queue = queue[1:]
+		for _, child := range children.Items {
+			if visited[gocloak.PString(child.ID)] {
+				continue
+			}
+			visited[gocloak.PString(child.ID)] = true
+			result = append(result, child)
+			queue = append(queue, child)
+		}
+	}
+	return result, warnings, nil
+}
+
+// subGroups returns the direct children of a group. Keycloak before 23 inlines
+// them in the group representation, newer versions serve them from the
+// children endpoint. Groups found by a search only inline the subgroups
+// leading to a match, so when the children endpoint is missing the group is
+// read again to get all of them.
+func (k *KeycloakClient) subGroups(ctx context.Context, realm string, group *gocloak.Group) (listing[*gocloak.Group], error) {
+	if group.SubGroups != nil && len(*group.SubGroups) > 0 {
+		return listing[*gocloak.Group]{
+			Items: lo.Map(*group.SubGroups, func(g gocloak.Group, _ int) *gocloak.Group {
+				return &g
+			}),
+		}, nil
+	}
+
+	key := k.cacheKey(realm, "children", gocloak.PString(group.ID))
+	return load(ctx, k, k.cacheSubGroups, key, defaultCacheExpiration, func(ctx context.Context) (listing[*gocloak.Group], error) {
+		children, err := listAll(k.pageSize, k.maxResults, func(first, max int) (page []*gocloak.Group, err error) {
+			err = k.call(ctx, func(ctx context.Context, token string) error {
+				page = nil
+				resp, err := k.keycloakClient.GetRequestWithBearerAuth(ctx, token).
+					SetResult(&page).
+					SetQueryParams(map[string]string{"first": strconv.Itoa(first), "max": strconv.Itoa(max)}).
+					Get(k.adminURL(realm, "groups", gocloak.PString(group.ID), "children"))
+				return checkResponse(resp, err, "could not get child groups")
+			})
+			return page, err
+		})
+		if isNotFound(err) {
+			return k.inlinedSubGroups(ctx, realm, gocloak.PString(group.ID))
+		}
+		return children, err
+	})
+}
+
+// inlinedSubGroups reads a group and returns the subgroups inlined in it. A
+// missing group has none.
+func (k *KeycloakClient) inlinedSubGroups(ctx context.Context, realm, id string) (listing[*gocloak.Group], error) {
+	var group *gocloak.Group
+	err := k.call(ctx, func(ctx context.Context, token string) (err error) {
+		group, err = k.keycloakClient.GetGroup(ctx, token, realm, id)
+		return err
+	})
+	if isNotFound(err) {
+		return listing[*gocloak.Group]{}, nil
+	}
+	if err != nil {
+		return listing[*gocloak.Group]{}, err
+	}
+	result := listing[*gocloak.Group]{Items: []*gocloak.Group{}}
+	if group.SubGroups != nil {
+		result.Items = lo.Map(*group.SubGroups, func(g gocloak.Group, _ int) *gocloak.Group { return &g })
+	}
+	return result, nil
+}
+
+// groupLabel names a group in messages, preferring its full path.
+func groupLabel(group *gocloak.Group) string {
+	if group.Path != nil {
+		return *group.Path
+	}
+	return gocloak.PString(group.Name)
+}
+
+// adminURL builds a URL below the admin API of realm.
+func (k *KeycloakClient) adminURL(realm string, path ...string) string {
+	return strings.Join(append([]string{strings.TrimRight(k.Url, "/"), "admin", "realms", realm}, path...), "/")
+}
+
+// checkResponse turns a failed raw request into a gocloak.APIError so it is
+// handled like the errors returned by gocloak itself.
+func checkResponse(resp *resty.Response, err error, msg string) error {
+	if err != nil {
+		return &gocloak.APIError{Message: fmt.Sprintf("%s: %s", msg, err.Error())}
+	}
+	if resp == nil {
+		return &gocloak.APIError{Message: fmt.Sprintf("%s: empty response", msg)}
+	}
+	if resp.IsError() {
+		return &gocloak.APIError{Code: resp.StatusCode(), Message: fmt.Sprintf("%s: %s", msg, resp.Status())}
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var apiErr *gocloak.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
@@ -3,7 +3,8 @@ package client
 import (
 	"context"
 	"fmt"
-	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/samber/lo"
@@ -16,114 +17,398 @@ const (
 	defaultCacheExpiration = 30 * time.Second
 )
 
+// KeycloakClientInterface is implemented by clients of a Keycloak instance.
+// Every call honors the deadline and cancellation of the supplied context.
 type KeycloakClientInterface interface {
-	GetToken() (string, error)
-	GetGroupMembers(groupName []string) ([]string, error)
+	GetToken(ctx context.Context) (string, error)
+	GetGroupMembers(ctx context.Context, realm string, groupName []string, opts GroupMembersOptions) (*GroupMembersResult, error)
+	GetRoleMembers(ctx context.Context, realm string, roleNames []string, opts RoleMembersOptions) (*GroupMembersResult, error)
+	GetOrganizationMembers(ctx context.Context, realm string, orgNames []string, opts OrganizationMembersOptions) (*OrganizationMembersResult, error)
+	GetUsers(ctx context.Context, realm string, userRefs []string) (*UsersResult, error)
+	GetUserMemberships(ctx context.Context, realm string, userRefs []string, opts UserMembershipsOptions) (*UserMembershipsResult, error)
+	// Close stops the background work of the client. It must not be used
+	// afterwards.
+	Close()
 }
 
+// GroupMembersOptions tunes how GetGroupMembers resolves groups.
+type GroupMembersOptions struct {
+	// IncludeSubgroupMembers also returns the members of every descendant
+	// of the requested groups.
+	IncludeSubgroupMembers bool
+	// Selectors pick further groups by pattern or attribute through
+	// Keycloak's group search.
+	Selectors []GroupSelector
+	// IncludeFederatedIdentities fills in User.FederatedIdentities, which
+	// costs one extra request per user.
+	IncludeFederatedIdentities bool
+}
+
+// GroupMembersResult is what GetGroupMembers or GetRoleMembers found.
+type GroupMembersResult struct {
+	Members []User
+	// Groups holds what became of each group reference, in the order they
+	// were asked for. Only GetGroupMembers fills it in.
+	Groups []GroupOutcome
+	// Unmatched holds the selectors that match no group, in the order they
+	// were given, leaving the caller to decide whether to warn about them.
+	Unmatched []GroupSelector
+	// Warnings describe listings that were cut off by the result cap.
+	Warnings []string
+}
+
+// GroupOutcome is what became of a group reference.
+type GroupOutcome struct {
+	// Ref is the reference as it was asked for.
+	Ref string
+	// Path is the full path of the group the reference resolved to.
+	Path string
+	// Missing is set when no group matches the reference. Its members are
+	// then left out rather than failing the lookup.
+	Missing bool
+}
+
+// KeycloakClient talks to a single Keycloak instance. It logs in to Realm and
+// can query any realm the client is allowed to read.
 type KeycloakClient struct {
 	ClientId     string
 	ClientSecret string
 	Realm        string
 	Url          string
 
-	cacheToken      *cache.Cache[string, string]
-	cacheGroup      *cache.Cache[string, map[string]*gocloak.Group]
-	cacheGroupUsers *cache.Cache[string, []string]
-	keycloakClient  *gocloak.GoCloak
-	ctx             context.Context
+	pageSize    int
+	maxResults  int
+	parallelism int
+	// maxStaleness is how long past their expiry cached values are served
+	// while Keycloak is unavailable.
+	maxStaleness time.Duration
+
+	retries      int
+	retryWait    time.Duration
+	retryMaxWait time.Duration
+	breaker      breaker
+
+	// ctx ends when the client is closed, stopping its cache janitors and
+	// background revalidations.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	shared sharedCalls
+	// revalidating holds the keys whose stale value is being refreshed in
+	// the background.
+	revalidating sync.Map
+	now          func() time.Time
+
+	tokenMu sync.Mutex
+	token   *token
+
+	cacheGroups        *cache.Cache[string, entry[listing[*gocloak.Group]]]
+	cacheGroup         *cache.Cache[string, entry[*gocloak.Group]]
+	cacheSubGroups     *cache.Cache[string, entry[listing[*gocloak.Group]]]
+	cacheGroupUsers    *cache.Cache[string, entry[listing[User]]]
+	cacheFederated     *cache.Cache[string, entry[map[string]string]]
+	cacheClient        *cache.Cache[string, entry[*gocloak.Client]]
+	cacheRole          *cache.Cache[string, entry[*gocloak.Role]]
+	cacheRoles         *cache.Cache[string, entry[listing[*gocloak.Role]]]
+	cacheRoleUsers     *cache.Cache[string, entry[listing[User]]]
+	cacheRoleGroups    *cache.Cache[string, entry[listing[*gocloak.Group]]]
+	cacheOrganization  *cache.Cache[string, entry[*organization]]
+	cacheOrganizations *cache.Cache[string, entry[listing[*organization]]]
+	cacheOrgMembers    *cache.Cache[string, entry[listing[organizationMember]]]
+	cacheUser          *cache.Cache[string, entry[*gocloak.User]]
+	cacheUserGroups    *cache.Cache[string, entry[listing[*gocloak.Group]]]
+	cacheUserRoles     *cache.Cache[string, entry[[]string]]
+	keycloakClient     *gocloak.GoCloak
 }
 
-func NewKeycloakClient() KeycloakClientInterface {
-	ctx := context.Background()
-	clientId := os.Getenv("KEYCLOAK_CLIENT_ID")
-	clientSecret := os.Getenv("KEYCLOAK_CLIENT_SECRET")
-	realm := os.Getenv("KEYCLOAK_REALM")
-	url := os.Getenv("KEYCLOAK_URL")
+// Option configures a KeycloakClient.
+type Option func(*KeycloakClient)
 
-	cacheToken := cache.New[string, string]()
-	cacheGroup := cache.New[string, map[string]*gocloak.Group]()
-	cacheGroupUsers := cache.New[string, []string]()
-	keycloakClient := gocloak.NewClient(url)
+// WithPageSize sets how many items are requested per page.
+func WithPageSize(n int) Option {
+	return func(k *KeycloakClient) {
+		if n > 0 {
+			k.pageSize = n
+		}
+	}
+}
 
-	return &KeycloakClient{
-		ClientId:     clientId,
-		ClientSecret: clientSecret,
-		Realm:        realm,
-		Url:          url,
+// WithMaxResults caps how many items are read from a single listing.
+func WithMaxResults(n int) Option {
+	return func(k *KeycloakClient) {
+		if n > 0 {
+			k.maxResults = n
+		}
+	}
+}
 
-		cacheToken:      cacheToken,
-		cacheGroup:      cacheGroup,
-		cacheGroupUsers: cacheGroupUsers,
-		keycloakClient:  keycloakClient,
-		ctx:             ctx,
+// WithParallelism caps the number of concurrent requests a single lookup
+// sends to Keycloak.
+func WithParallelism(n int) Option {
+	return func(k *KeycloakClient) {
+		if n > 0 {
+			k.parallelism = n
+		}
 	}
 }
 
-func (k *KeycloakClient) GetToken() (string, error) {
-	token, exist := k.cacheToken.Get("token")
-	if !exist {
-		token, err := k.keycloakClient.LoginClient(k.ctx, k.ClientId, k.ClientSecret, k.Realm)
-		if err != nil {
-			k.cacheToken.Delete("token")
-			return "", err
+// WithMaxStaleness serves cached values for up to d past their expiry when
+// Keycloak is unavailable, instead of failing. Zero disables it.
+func WithMaxStaleness(d time.Duration) Option {
+	return func(k *KeycloakClient) {
+		if d >= 0 {
+			k.maxStaleness = d
 		}
-		k.cacheToken.Set("token", token.AccessToken, cache.WithExpiration(5*time.Minute))
-		return token.AccessToken, nil
 	}
-	return token, nil
 }
 
-func (k *KeycloakClient) GetGroupMembers(groupName []string) ([]string, error) {
-	token, err := k.GetToken()
+func NewKeycloakClient(cfg Config, opts ...Option) KeycloakClientInterface {
+	ctx, cancel := context.WithCancel(context.Background())
+	cacheGroups := cache.NewContext[string, entry[listing[*gocloak.Group]]](ctx)
+	cacheGroup := cache.NewContext[string, entry[*gocloak.Group]](ctx)
+	cacheSubGroups := cache.NewContext[string, entry[listing[*gocloak.Group]]](ctx)
+	cacheGroupUsers := cache.NewContext[string, entry[listing[User]]](ctx)
+	cacheFederated := cache.NewContext[string, entry[map[string]string]](ctx)
+	cacheClient := cache.NewContext[string, entry[*gocloak.Client]](ctx)
+	cacheRole := cache.NewContext[string, entry[*gocloak.Role]](ctx)
+	cacheRoles := cache.NewContext[string, entry[listing[*gocloak.Role]]](ctx)
+	cacheRoleUsers := cache.NewContext[string, entry[listing[User]]](ctx)
+	cacheRoleGroups := cache.NewContext[string, entry[listing[*gocloak.Group]]](ctx)
+	cacheOrganization := cache.NewContext[string, entry[*organization]](ctx)
+	cacheOrganizations := cache.NewContext[string, entry[listing[*organization]]](ctx)
+	cacheOrgMembers := cache.NewContext[string, entry[listing[organizationMember]]](ctx)
+	cacheUser := cache.NewContext[string, entry[*gocloak.User]](ctx)
+	cacheUserGroups := cache.NewContext[string, entry[listing[*gocloak.Group]]](ctx)
+	cacheUserRoles := cache.NewContext[string, entry[[]string]](ctx)
+	keycloakClient := gocloak.NewClient(cfg.Url)
+
+	k := &KeycloakClient{
+		ClientId:     cfg.ClientId,
+		ClientSecret: cfg.ClientSecret,
+		Realm:        cfg.Realm,
+		Url:          cfg.Url,
+
+		pageSize:    defaultPageSize,
+		maxResults:  defaultMaxResults,
+		parallelism: defaultParallelism,
+
+		retries:      defaultRetries,
+		retryWait:    defaultRetryWait,
+		retryMaxWait: defaultRetryMaxWait,
+		breaker:      breaker{threshold: defaultBreakerThreshold, cooldown: defaultBreakerCooldown},
+
+		ctx:    ctx,
+		cancel: cancel,
+		now:    time.Now,
+
+		cacheGroups:        cacheGroups,
+		cacheGroup:         cacheGroup,
+		cacheSubGroups:     cacheSubGroups,
+		cacheGroupUsers:    cacheGroupUsers,
+		cacheFederated:     cacheFederated,
+		cacheClient:        cacheClient,
+		cacheRole:          cacheRole,
+		cacheRoles:         cacheRoles,
+		cacheRoleUsers:     cacheRoleUsers,
+		cacheRoleGroups:    cacheRoleGroups,
+		cacheOrganization:  cacheOrganization,
+		cacheOrganizations: cacheOrganizations,
+		cacheOrgMembers:    cacheOrgMembers,
+		cacheUser:          cacheUser,
+		cacheUserGroups:    cacheUserGroups,
+		cacheUserRoles:     cacheUserRoles,
+		keycloakClient:     keycloakClient,
+	}
+	for _, o := range opts {
+		o(k)
+	}
+	k.configureRetries(keycloakClient.RestyClient())
+	return k
+}
+
+// Close stops the cache janitors and background revalidations of the client.
+func (k *KeycloakClient) Close() {
+	k.cancel()
+}
+
+// GetGroupMembers returns the members of the referenced groups, and of the
+// groups picked by opts.Selectors, in realm. An empty realm queries the realm
+// the client logs in to. Groups are referenced by full path, ID or top-level
+// name. References to missing groups are reported in the result's Groups,
+// and selectors matching no group in its Unmatched, rather than as errors,
+// leaving the caller to decide what they mean.
+func (k *KeycloakClient) GetGroupMembers(ctx context.Context, realm string, groupName []string, opts GroupMembersOptions) (*GroupMembersResult, error) {
+	if realm == "" {
+		realm = k.Realm
+	}
+	ctx, stale := withStaleReport(ctx)
+
+	// Resolve the references, and their descendants when asked for, then
+	// fetch the members of every group found. Results are collected by
+	// index so the output order does not depend on scheduling.
+	resolved := make([][]*gocloak.Group, len(groupName))
+	resolveWarnings := make([][]string, len(groupName))
+	outcomes := make([]GroupOutcome, len(groupName))
+	err := k.forEach(ctx, len(groupName), func(ctx context.Context, i int) error {
+		outcomes[i] = GroupOutcome{Ref: groupName[i]}
+		group, err := k.resolveGroup(ctx, realm, groupName[i])
+		if err != nil {
+			return err
+		}
+		if group == nil {
+			outcomes[i].Missing = true
+			return nil
+		}
+
+		outcomes[i].Path = groupLabel(group)
+		resolved[i] = []*gocloak.Group{group}
+		if opts.IncludeSubgroupMembers {
+			descendants, warnings, err := k.descendants(ctx, realm, group)
+			if err != nil {
+				return err
+			}
+			resolved[i] = append(resolved[i], descendants...)
+			resolveWarnings[i] = warnings
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	groups, exist := k.cacheGroup.Get("groups")
-	if !exist {
-		groupsKeycloak, err := k.keycloakClient.GetGroups(k.ctx, token, k.Realm, gocloak.GetGroupsParams{})
-		fmt.Println(groupsKeycloak)
+	selected := make([][]*gocloak.Group, len(opts.Selectors))
+	selectWarnings := make([][]string, len(opts.Selectors))
+	err = k.forEach(ctx, len(opts.Selectors), func(ctx context.Context, i int) error {
+		groups, err := k.selectGroups(ctx, realm, opts.Selectors[i])
 		if err != nil {
-			k.cacheGroup.Delete("groups")
-			return nil, err
+			return err
+		}
+		if groups.Truncated {
+			selectWarnings[i] = append(selectWarnings[i], fmt.Sprintf("group selector %s found more than %d groups, only the first %d are searched", opts.Selectors[i], k.maxResults, k.maxResults))
+		}
+		for _, group := range groups.Items {
+			selected[i] = append(selected[i], group)
+			if opts.IncludeSubgroupMembers {
+				descendants, warnings, err := k.descendants(ctx, realm, group)
+				if err != nil {
+					return err
+				}
+				selected[i] = append(selected[i], descendants...)
+				selectWarnings[i] = append(selectWarnings[i], warnings...)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		groups = make(map[string]*gocloak.Group)
-		lo.ForEach(groupsKeycloak, func(item *gocloak.Group, index int) {
-			groups[*item.Name] = item
-		})
+	// Groups picked by selectors are only added once, and not again when
+	// already referenced by name.
+	groups := lo.Flatten(resolved)
+	seen := lo.SliceToMap(groups, func(g *gocloak.Group) (string, bool) { return gocloak.PString(g.ID), true })
+	for _, g := range lo.Flatten(selected) {
+		if !seen[gocloak.PString(g.ID)] {
+			seen[gocloak.PString(g.ID)] = true
+			groups = append(groups, g)
+		}
+	}
+
+	result := &GroupMembersResult{Members: []User{}, Groups: outcomes, Warnings: append(lo.Flatten(resolveWarnings), lo.Flatten(selectWarnings)...)}
+	for i, selector := range opts.Selectors {
+		if len(selected[i]) == 0 {
+			result.Unmatched = append(result.Unmatched, selector)
+		}
+	}
+	if err := k.addGroupMembers(ctx, realm, groups, result); err != nil {
+		return nil, err
+	}
+	return k.finish(ctx, realm, result, opts.IncludeFederatedIdentities, stale)
+}
 
-		k.cacheGroup.Set("groups", groups, cache.WithExpiration(defaultCacheExpiration))
+// addGroupMembers appends the members of groups to result. Members of several
+// groups are listed once per group, each entry carrying the path of the group
+// it came from.
+func (k *KeycloakClient) addGroupMembers(ctx context.Context, realm string, groups []*gocloak.Group, result *GroupMembersResult) error {
+	members := make([]listing[User], len(groups))
+	err := k.forEach(ctx, len(groups), func(ctx context.Context, i int) error {
+		var err error
+		members[i], err = k.groupMembers(ctx, realm, groups[i])
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	groupMembers := []string{}
-	for _, g := range groupName {
-		group := groups[g]
-		if group == nil {
-			return nil, fmt.Errorf("group %s not exists", g)
+	for i, group := range groups {
+		if members[i].Truncated {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("group %s has more than %d members, only the first %d are returned", groupLabel(group), k.maxResults, k.maxResults))
 		}
+		for _, m := range members[i].Items {
+			m.Groups = []string{groupLabel(group)}
+			result.Members = append(result.Members, m)
+		}
+	}
+	return nil
+}
 
-		members, exists := k.cacheGroupUsers.Get(k.getGroupKey(*group.Name))
-		if !exists {
-			membersKeycloak, err := k.keycloakClient.GetGroupMembers(k.ctx, token, k.Realm, *group.ID, gocloak.GetGroupsParams{})
+// finish fills in the federated identities of the members when asked for and
+// warns about stale values served to the lookup.
+func (k *KeycloakClient) finish(ctx context.Context, realm string, result *GroupMembersResult, federated bool, stale *staleReport) (*GroupMembersResult, error) {
+	if federated {
+		err := k.forEach(ctx, len(result.Members), func(ctx context.Context, i int) error {
+			links, err := k.federatedIdentities(ctx, realm, result.Members[i].ID)
 			if err != nil {
-				k.cacheGroupUsers.Delete(k.getGroupKey(*group.Name))
-				return nil, err
+				return err
 			}
-			members = lo.Map(membersKeycloak, func(item *gocloak.User, _ int) string {
-				if item.Email == nil {
-					return "None"
-				}
-				return *item.Email
-			})
-			k.cacheGroupUsers.Set(k.getGroupKey(*group.Name), members, cache.WithExpiration(defaultCacheExpiration))
+			result.Members[i].FederatedIdentities = links
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
-		groupMembers = append(groupMembers, members...)
 	}
-	return groupMembers, nil
+
+	if since, ok := stale.since(); ok {
+		result.Warnings = append(result.Warnings, k.staleWarning(since))
+	}
+	if len(result.Warnings) == 0 {
+		result.Warnings = nil
+	}
+	return result, nil
+}
+
+// staleWarning tells that a lookup was served values cached since then.
+func (k *KeycloakClient) staleWarning(since time.Time) string {
+	return fmt.Sprintf("Keycloak is unavailable, returning data cached %s ago", k.now().Sub(since).Round(time.Second))
+}
+
+// groupMembers returns the direct members of a group.
+func (k *KeycloakClient) groupMembers(ctx context.Context, realm string, group *gocloak.Group) (listing[User], error) {
+	key := k.cacheKey(realm, "group", *group.ID)
+	return load(ctx, k, k.cacheGroupUsers, key, defaultCacheExpiration, func(ctx context.Context) (listing[User], error) {
+		membersKeycloak, err := listAll(k.pageSize, k.maxResults, func(first, max int) (page []*gocloak.User, err error) {
+			err = k.call(ctx, func(ctx context.Context, token string) error {
+				page, err = k.keycloakClient.GetGroupMembers(ctx, token, realm, *group.ID, gocloak.GetGroupsParams{
+					First: gocloak.IntP(first),
+					Max:   gocloak.IntP(max),
+				})
+				return err
+			})
+			return page, err
+		})
+		if err != nil {
+			return listing[User]{}, err
+		}
+		return listing[User]{
+			Items:     lo.Map(membersKeycloak.Items, func(item *gocloak.User, _ int) User { return newUser(item) }),
+			Truncated: membersKeycloak.Truncated,
+		}, nil
+	})
 }
 
-func (k *KeycloakClient) getGroupKey(groupName string) string {
-	return fmt.Sprintf("group-%s", groupName)
+// cacheKey namespaces a cache entry by the Keycloak instance and realm so
+// clients sharing a cache never mix up data from different realms.
+func (k *KeycloakClient) cacheKey(realm string, parts ...string) string {
+	return strings.Join(append([]string{k.Url, realm}, parts...), "|")
 }
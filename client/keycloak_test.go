@@ -0,0 +1,1857 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/samber/lo"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+)
+
+const (
+	groupEngineering = "00000000-0000-0000-0000-000000000001"
+	groupPlatform    = "00000000-0000-0000-0000-000000000002"
+	groupPlatAdmins  = "00000000-0000-0000-0000-000000000003"
+	groupSales       = "00000000-0000-0000-0000-000000000004"
+	clientApp        = "00000000-0000-0000-0000-0000000000a1"
+	groupSalesAdmins = "00000000-0000-0000-0000-000000000005"
+	groupLarge       = "00000000-0000-0000-0000-000000000006"
+	orgAcme          = "00000000-0000-0000-0000-0000000000b1"
+	orgGlobex        = "00000000-0000-0000-0000-0000000000b2"
+	userPat          = "00000000-0000-0000-0000-0000000000c1"
+)
+
+// fakeKeycloak serves the parts of the Keycloak admin API the client uses.
+type fakeKeycloak struct {
+	groups   map[string]*gocloak.Group
+	children map[string][]string
+	members  map[string][]*gocloak.User
+	clients  []*gocloak.Client
+	roles    []*fakeRole
+	orgs     []*fakeOrganization
+	// users that belong to nothing, in addition to the members of groups
+	// and roles.
+	users []*gocloak.User
+
+	// legacy serves groups the way Keycloak before 23 does, without the
+	// children endpoint and with every subgroup inlined in groups read by ID
+	// or path.
+	legacy bool
+	// delay is added to every response.
+	delay time.Duration
+	// expiresIn and refreshExpiresIn are the token lifetimes in seconds.
+	// No refresh token is issued when refreshExpiresIn is 0.
+	expiresIn        int
+	refreshExpiresIn int
+	// retryAfter is sent along with the failures.
+	retryAfter string
+
+	mu      sync.Mutex
+	hits    map[string]int
+	grants  map[string]int
+	issued  int
+	revoked map[string]bool
+	// failures is how many of the next admin requests are answered with 503.
+	failures int
+	// listings counts the requests listing top-level groups without a search.
+	listings int
+	// inFlight and maxInFlight count the admin requests being served.
+	inFlight    int
+	maxInFlight int
+}
+
+func newFakeKeycloak() *fakeKeycloak {
+	group := func(id, name, path string, attributes ...string) *gocloak.Group {
+		g := &gocloak.Group{ID: gocloak.StringP(id), Name: gocloak.StringP(name), Path: gocloak.StringP(path)}
+		if len(attributes) > 0 {
+			attrs := map[string][]string{}
+			for i := 0; i+1 < len(attributes); i += 2 {
+				attrs[attributes[i]] = append(attrs[attributes[i]], attributes[i+1])
+			}
+			g.Attributes = &attrs
+		}
+		return g
+	}
+	user := func(email string) *gocloak.User {
+		return &gocloak.User{ID: gocloak.StringP(email), Username: gocloak.StringP(email), Email: gocloak.StringP(email)}
+	}
+	role := func(name, client string) *gocloak.Role {
+		return &gocloak.Role{ID: gocloak.StringP("role-" + name), Name: gocloak.StringP(name), ClientRole: gocloak.BoolP(client != ""), ContainerID: gocloak.StringP(client)}
+	}
+	large := make([]*gocloak.User, 0, 250)
+	for i := range 250 {
+		large = append(large, user(fmt.Sprintf("user%03d@example.com", i)))
+	}
+	return &fakeKeycloak{
+		expiresIn: 300,
+		hits:      map[string]int{},
+		grants:    map[string]int{},
+		revoked:   map[string]bool{},
+		groups: map[string]*gocloak.Group{
+			groupLarge:       group(groupLarge, "large", "/large"),
+			groupEngineering: group(groupEngineering, "engineering", "/engineering"),
+			groupPlatform:    group(groupPlatform, "platform", "/engineering/platform", "team", "platform"),
+			groupPlatAdmins:  group(groupPlatAdmins, "admins", "/engineering/platform/admins", "team", "platform", "access", "admin"),
+			groupSales:       group(groupSales, "sales", "/sales"),
+			groupSalesAdmins: group(groupSalesAdmins, "admins", "/sales/admins", "team", "sales", "access", "admin"),
+		},
+		children: map[string][]string{
+			groupEngineering: {groupPlatform},
+			groupPlatform:    {groupPlatAdmins},
+			groupSales:       {groupSalesAdmins},
+		},
+		members: map[string][]*gocloak.User{
+			groupEngineering: {user("eng@example.com")},
+			groupPlatform:    {user("platform@example.com")},
+			groupPlatAdmins:  {user("platform-admin@example.com")},
+			groupSales:       {user("sales@example.com")},
+			groupSalesAdmins: {user("sales-admin@example.com")},
+			groupLarge:       large,
+		},
+		clients: []*gocloak.Client{
+			{ID: gocloak.StringP(clientApp), ClientID: gocloak.StringP("app")},
+		},
+		roles: []*fakeRole{
+			{role: role("viewer", ""), users: []*gocloak.User{user("viewer@example.com")}, groups: []string{groupSales}},
+			{role: role("editor", ""), users: []*gocloak.User{user("editor@example.com")}, composites: []string{"viewer"}},
+			{role: role("admin", ""), users: []*gocloak.User{user("admin@example.com")}, composites: []string{"editor", "app-user"}},
+			{role: role("unrelated", ""), users: []*gocloak.User{user("unrelated@example.com")}},
+			{role: role("app-user", clientApp), users: []*gocloak.User{user("app-user@example.com")}},
+			{role: role("app-admin", clientApp), users: []*gocloak.User{user("app-admin@example.com")}, composites: []string{"app-user"}},
+		},
+		users: []*gocloak.User{
+			{ID: gocloak.StringP(userPat), Username: gocloak.StringP("pat"), Email: gocloak.StringP("pat@example.com"), Enabled: gocloak.BoolP(true)},
+		},
+		orgs: []*fakeOrganization{
+			{
+				organization: organization{ID: orgAcme, Name: "Acme Corp", Alias: "acme", Domains: []organizationDomain{{Name: "acme.com", Verified: true}, {Name: "acme.io"}}},
+				members: []organizationMember{
+					{User: *user("alice@acme.com"), MembershipType: MembershipManaged},
+					{User: *user("bob@example.com"), MembershipType: MembershipUnmanaged},
+				},
+			},
+			{
+				organization: organization{ID: orgGlobex, Name: "Globex", Alias: "globex", Domains: []organizationDomain{{Name: "globex.com"}, {Name: "acme.io"}}},
+				members: []organizationMember{
+					{User: *user("carol@globex.com"), MembershipType: MembershipManaged},
+				},
+			},
+		},
+	}
+}
+
+// fakeOrganization is an organization along with its members.
+type fakeOrganization struct {
+	organization
+	members []organizationMember
+}
+
+// fakeRole is a role along with what it is mapped to.
+type fakeRole struct {
+	role       *gocloak.Role
+	users      []*gocloak.User
+	groups     []string
+	composites []string
+}
+
+// findRole returns the role named name in container, the ID of its client or
+// empty for realm roles.
+func (f *fakeKeycloak) findRole(container, name string) (*fakeRole, bool) {
+	return lo.Find(f.roles, func(r *fakeRole) bool {
+		return *r.role.Name == name && (container == "") == !*r.role.ClientRole && (container == "" || *r.role.ContainerID == container)
+	})
+}
+
+// allUsers returns every user the fake knows about, each listed once.
+func (f *fakeKeycloak) allUsers() []*gocloak.User {
+	users := slices.Clone(f.users)
+	for _, members := range f.members {
+		users = append(users, members...)
+	}
+	for _, r := range f.roles {
+		users = append(users, r.users...)
+	}
+	return lo.UniqBy(users, func(u *gocloak.User) string { return *u.ID })
+}
+
+// userGroups returns the groups the user is a direct member of.
+func (f *fakeKeycloak) userGroups(userID string) []*gocloak.Group {
+	groups := []*gocloak.Group{}
+	for id, members := range f.members {
+		if lo.ContainsBy(members, func(u *gocloak.User) bool { return *u.ID == userID }) {
+			groups = append(groups, f.groups[id])
+		}
+	}
+	slices.SortFunc(groups, func(a, b *gocloak.Group) int { return strings.Compare(*a.Path, *b.Path) })
+	return groups
+}
+
+// effectiveRoles returns the roles of container the user holds directly,
+// through a group or an ancestor of one, or through a composite role.
+func (f *fakeKeycloak) effectiveRoles(userID, container string) []*gocloak.Role {
+	inherited := map[string]bool{}
+	for _, g := range f.userGroups(userID) {
+		for id, candidate := range f.groups {
+			if *candidate.Path == *g.Path || strings.HasPrefix(*g.Path, *candidate.Path+"/") {
+				inherited[id] = true
+			}
+		}
+	}
+	held := map[string]bool{}
+	queue := []string{}
+	for _, r := range f.roles {
+		if lo.ContainsBy(r.users, func(u *gocloak.User) bool { return *u.ID == userID }) || lo.SomeBy(r.groups, func(id string) bool { return inherited[id] }) {
+			held[*r.role.Name] = true
+			queue = append(queue, *r.role.Name)
+		}
+	}
+	for len(queue) > 0 {
+		r, _ := lo.Find(f.roles, func(r *fakeRole) bool { return *r.role.Name == queue[0] })
+		queue = queue[1:]
+		for _, c := range r.composites {
+			if !held[c] {
+				held[c] = true
+				queue = append(queue, c)
+			}
+		}
+	}
+	return lo.FilterMap(f.roles, func(r *fakeRole, _ int) (*gocloak.Role, bool) {
+		return r.role, held[*r.role.Name] && *r.role.ContainerID == container
+	})
+}
+
+// searchTree returns a copy of group holding only the subgroups leading to
+// groups matching match, the way Keycloak's group search does, or false when
+// there are none.
+func (f *fakeKeycloak) searchTree(group *gocloak.Group, match func(*gocloak.Group) bool) (*gocloak.Group, bool) {
+	var subGroups []gocloak.Group
+	for _, id := range f.children[*group.ID] {
+		if sub, ok := f.searchTree(f.groups[id], match); ok {
+			subGroups = append(subGroups, *sub)
+		}
+	}
+	if len(subGroups) == 0 && !match(group) {
+		return nil, false
+	}
+	g := *group
+	g.SubGroups = &subGroups
+	return &g, true
+}
+
+// representation returns group as read by ID or path, holding all of its
+// subgroups when f is legacy.
+func (f *fakeKeycloak) representation(group *gocloak.Group) *gocloak.Group {
+	if !f.legacy {
+		return group
+	}
+	subGroups := []gocloak.Group{}
+	for _, id := range f.children[*group.ID] {
+		subGroups = append(subGroups, *f.representation(f.groups[id]))
+	}
+	g := *group
+	g.SubGroups = &subGroups
+	return &g
+}
+
+// page applies the first and max query parameters of r to items.
+func page[T any](r *http.Request, items []T) []T {
+	first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+	first = min(first, len(items))
+	max := len(items) - first
+	if v := r.URL.Query().Get("max"); v != "" {
+		n, _ := strconv.Atoi(v)
+		max = min(max, n)
+	}
+	return items[first : first+max]
+}
+
+func (f *fakeKeycloak) server(t *testing.T) *httptest.Server {
+	t.Helper()
+	write := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /realms/{realm}/protocol/openid-connect/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		f.mu.Lock()
+		f.issued++
+		f.grants[r.Form.Get("grant_type")]++
+		jwt := map[string]any{"access_token": fmt.Sprintf("token-%d", f.issued), "expires_in": f.expiresIn}
+		if f.refreshExpiresIn > 0 {
+			jwt["refresh_token"] = fmt.Sprintf("refresh-%d", f.issued)
+			jwt["refresh_expires_in"] = f.refreshExpiresIn
+		}
+		f.mu.Unlock()
+		write(w, jwt)
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/groups", func(w http.ResponseWriter, r *http.Request) {
+		topLevel := []*gocloak.Group{f.groups[groupEngineering], f.groups[groupSales], f.groups[groupLarge]}
+		q := r.URL.Query()
+		if !q.Has("search") && !q.Has("q") {
+			f.mu.Lock()
+			f.listings++
+			f.mu.Unlock()
+			write(w, page(r, topLevel))
+			return
+		}
+		match := func(g *gocloak.Group) bool {
+			if q.Get("exact") == "true" {
+				return *g.Name == q.Get("search")
+			}
+			if q.Has("search") {
+				return strings.Contains(strings.ToLower(*g.Name), strings.ToLower(q.Get("search")))
+			}
+			for _, term := range strings.Fields(q.Get("q")) {
+				k, v, _ := strings.Cut(term, ":")
+				if g.Attributes == nil || !slices.Contains((*g.Attributes)[k], v) {
+					return false
+				}
+			}
+			return true
+		}
+		write(w, page(r, lo.FilterMap(topLevel, func(g *gocloak.Group, _ int) (*gocloak.Group, bool) {
+			return f.searchTree(g, match)
+		})))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		g, ok := f.groups[r.PathValue("id")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		write(w, f.representation(g))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/groups/{id}/children", func(w http.ResponseWriter, r *http.Request) {
+		if f.legacy {
+			http.NotFound(w, r)
+			return
+		}
+		children := []*gocloak.Group{}
+		for _, id := range f.children[r.PathValue("id")] {
+			children = append(children, f.groups[id])
+		}
+		write(w, page(r, children))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/groups/{id}/members", func(w http.ResponseWriter, r *http.Request) {
+		write(w, page(r, f.members[r.PathValue("id")]))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/clients", func(w http.ResponseWriter, r *http.Request) {
+		write(w, lo.Filter(f.clients, func(c *gocloak.Client, _ int) bool { return *c.ClientID == r.URL.Query().Get("clientId") }))
+	})
+	roles := func(w http.ResponseWriter, r *http.Request, container string) {
+		found := lo.Filter(f.roles, func(fr *fakeRole, _ int) bool {
+			_, ok := f.findRole(container, *fr.role.Name)
+			return ok
+		})
+		write(w, page(r, lo.Map(found, func(fr *fakeRole, _ int) *gocloak.Role {
+			role := *fr.role
+			role.Composite = gocloak.BoolP(len(fr.composites) > 0)
+			return &role
+		})))
+	}
+	role := func(w http.ResponseWriter, r *http.Request, container string) {
+		fr, ok := f.findRole(container, r.PathValue("name"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.PathValue("sub") {
+		case "":
+			write(w, fr.role)
+		case "users":
+			write(w, page(r, fr.users))
+		case "groups":
+			write(w, page(r, lo.Map(fr.groups, func(id string, _ int) *gocloak.Group { return f.groups[id] })))
+		default:
+			http.NotFound(w, r)
+		}
+	}
+	mux.HandleFunc("GET /admin/realms/{realm}/roles", func(w http.ResponseWriter, r *http.Request) { roles(w, r, "") })
+	mux.HandleFunc("GET /admin/realms/{realm}/roles/{name}", func(w http.ResponseWriter, r *http.Request) { role(w, r, "") })
+	mux.HandleFunc("GET /admin/realms/{realm}/roles/{name}/{sub}", func(w http.ResponseWriter, r *http.Request) { role(w, r, "") })
+	mux.HandleFunc("GET /admin/realms/{realm}/clients/{id}/roles", func(w http.ResponseWriter, r *http.Request) { roles(w, r, r.PathValue("id")) })
+	mux.HandleFunc("GET /admin/realms/{realm}/clients/{id}/roles/{name}", func(w http.ResponseWriter, r *http.Request) { role(w, r, r.PathValue("id")) })
+	mux.HandleFunc("GET /admin/realms/{realm}/clients/{id}/roles/{name}/{sub}", func(w http.ResponseWriter, r *http.Request) { role(w, r, r.PathValue("id")) })
+	mux.HandleFunc("GET /admin/realms/{realm}/roles-by-id/{id}/composites", func(w http.ResponseWriter, r *http.Request) {
+		fr, ok := lo.Find(f.roles, func(fr *fakeRole) bool { return *fr.role.ID == r.PathValue("id") })
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		write(w, lo.Map(fr.composites, func(name string, _ int) *gocloak.Role {
+			c, _ := lo.Find(f.roles, func(c *fakeRole) bool { return *c.role.Name == name })
+			return c.role
+		}))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/organizations", func(w http.ResponseWriter, r *http.Request) {
+		write(w, page(r, lo.Map(f.orgs, func(o *fakeOrganization, _ int) organization { return o.organization })))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/organizations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		o, ok := lo.Find(f.orgs, func(o *fakeOrganization) bool { return o.ID == r.PathValue("id") })
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		write(w, o.organization)
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/organizations/{id}/members", func(w http.ResponseWriter, r *http.Request) {
+		o, ok := lo.Find(f.orgs, func(o *fakeOrganization) bool { return o.ID == r.PathValue("id") })
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		write(w, page(r, o.members))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/users", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		write(w, page(r, lo.Filter(f.allUsers(), func(u *gocloak.User, _ int) bool {
+			return (!q.Has("email") || *u.Email == q.Get("email")) && (!q.Has("username") || *u.Username == q.Get("username"))
+		})))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := lo.Find(f.allUsers(), func(u *gocloak.User) bool { return *u.ID == r.PathValue("id") })
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		write(w, u)
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/users/{id}/groups", func(w http.ResponseWriter, r *http.Request) {
+		write(w, page(r, f.userGroups(r.PathValue("id"))))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/users/{id}/role-mappings/realm/composite", func(w http.ResponseWriter, r *http.Request) {
+		write(w, f.effectiveRoles(r.PathValue("id"), ""))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/users/{id}/role-mappings/clients/{client}/composite", func(w http.ResponseWriter, r *http.Request) {
+		write(w, f.effectiveRoles(r.PathValue("id"), r.PathValue("client")))
+	})
+	mux.HandleFunc("GET /admin/realms/{realm}/group-by-path/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		for _, g := range f.groups {
+			if *g.Path == "/"+r.PathValue("path") {
+				write(w, f.representation(g))
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.hits[r.Method+" "+r.URL.Path]++
+		admin := strings.HasPrefix(r.URL.Path, "/admin/")
+		revoked := f.revoked[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		failing := admin && f.failures > 0
+		if failing {
+			f.failures--
+		}
+		if admin {
+			f.inFlight++
+			f.maxInFlight = max(f.maxInFlight, f.inFlight)
+			defer func() {
+				f.mu.Lock()
+				f.inFlight--
+				f.mu.Unlock()
+			}()
+		}
+		f.mu.Unlock()
+		time.Sleep(f.delay)
+		if failing {
+			if f.retryAfter != "" {
+				w.Header().Set("Retry-After", f.retryAfter)
+			}
+			http.Error(w, `{"error":"HTTP 503 Service Unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		if revoked && admin {
+			http.Error(w, `{"error":"HTTP 401 Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// requests returns how often the path was requested with the method.
+func (f *fakeKeycloak) requests(method, path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hits[method+" "+path]
+}
+
+func TestGetGroupMembers(t *testing.T) {
+	type args struct {
+		canceled   bool
+		clientOpts []Option
+		groups     []string
+		opts       GroupMembersOptions
+	}
+	type want struct {
+		members  []string
+		outcomes []GroupOutcome
+		warnings []string
+		err      bool
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"TopLevelName": {
+			reason: "Top-level groups should still resolve by name",
+			args: args{
+				groups: []string{"engineering"},
+			},
+			want: want{
+				members: []string{"eng@example.com"},
+			},
+		},
+		"NestedPath": {
+			reason: "Nested groups should resolve by full path",
+			args: args{
+				groups: []string{"/engineering/platform/admins", "/sales/admins"},
+			},
+			want: want{
+				members: []string{"platform-admin@example.com", "sales-admin@example.com"},
+			},
+		},
+		"ID": {
+			reason: "Groups should resolve by ID",
+			args: args{
+				groups: []string{groupSalesAdmins},
+			},
+			want: want{
+				members: []string{"sales-admin@example.com"},
+			},
+		},
+		"IncludeSubgroupMembers": {
+			reason: "Members of every descendant group should be returned when asked for",
+			args: args{
+				groups: []string{"/engineering"},
+				opts:   GroupMembersOptions{IncludeSubgroupMembers: true},
+			},
+			want: want{
+				members: []string{"eng@example.com", "platform@example.com", "platform-admin@example.com"},
+			},
+		},
+		"TopLevelNameIncludeSubgroupMembers": {
+			reason: "Members of every descendant should be returned for a group found by name",
+			args: args{
+				groups: []string{"engineering"},
+				opts:   GroupMembersOptions{IncludeSubgroupMembers: true},
+			},
+			want: want{
+				members: []string{"eng@example.com", "platform@example.com", "platform-admin@example.com"},
+			},
+		},
+		"PagesThroughMembers": {
+			reason: "Members spread over several pages should all be returned",
+			args: args{
+				clientOpts: []Option{WithPageSize(100)},
+				groups:     []string{"large"},
+			},
+			want: want{
+				members: users(0, 250),
+			},
+		},
+		"MaxResultsWarns": {
+			reason: "Hitting the result cap should return the capped members and a warning",
+			args: args{
+				clientOpts: []Option{WithPageSize(30), WithMaxResults(200)},
+				groups:     []string{"/large"},
+			},
+			want: want{
+				members:  users(0, 200),
+				warnings: []string{"group /large has more than 200 members, only the first 200 are returned"},
+			},
+		},
+		"MaxResultsExactlyReached": {
+			reason: "A group holding exactly the capped number of members should not warn",
+			args: args{
+				clientOpts: []Option{WithMaxResults(250)},
+				groups:     []string{"/large"},
+			},
+			want: want{
+				members: users(0, 250),
+			},
+		},
+		"CanceledContext": {
+			reason: "A canceled request context should stop the lookup",
+			args: args{
+				canceled: true,
+				groups:   []string{"engineering"},
+			},
+			want: want{
+				err: true,
+			},
+		},
+		"MissingGroup": {
+			reason: "A group that does not exist should be reported in the outcomes rather than fail the lookup",
+			args: args{
+				groups: []string{"/engineering/missing", "/sales/admins", "missing"},
+			},
+			want: want{
+				members: []string{"sales-admin@example.com"},
+				outcomes: []GroupOutcome{
+					{Ref: "/engineering/missing", Missing: true},
+					{Ref: "/sales/admins", Path: "/sales/admins"},
+					{Ref: "missing", Missing: true},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeKeycloak()
+			srv := fake.server(t)
+			k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"}, tc.args.clientOpts...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.args.canceled {
+				cancel()
+			}
+
+			result, err := k.GetGroupMembers(ctx, "", tc.args.groups, tc.args.opts)
+			if fake.listings > 0 {
+				t.Errorf("%s\nk.GetGroupMembers(...): listed every group %d times, want searches only", tc.reason, fake.listings)
+			}
+			if (err != nil) != tc.want.err {
+				t.Fatalf("%s\nk.GetGroupMembers(...): want error %t, got %v", tc.reason, tc.want.err, err)
+			}
+			if err != nil {
+				return
+			}
+			emails := lo.Map(result.Members, func(u User, _ int) string { return u.Email })
+			if diff := cmp.Diff(tc.want.members, emails); diff != "" {
+				t.Errorf("%s\nk.GetGroupMembers(...): -want members, +got members:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.warnings, result.Warnings); diff != "" {
+				t.Errorf("%s\nk.GetGroupMembers(...): -want warnings, +got warnings:\n%s", tc.reason, diff)
+			}
+			if tc.want.outcomes != nil {
+				if diff := cmp.Diff(tc.want.outcomes, result.Groups); diff != "" {
+					t.Errorf("%s\nk.GetGroupMembers(...): -want outcomes, +got outcomes:\n%s", tc.reason, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestGetGroupMembersBeforeKeycloak23(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		groups []string
+		opts   GroupMembersOptions
+		want   []string
+	}{
+		"Path": {
+			reason: "Subgroups inlined in a group read by path should be used without the children endpoint",
+			groups: []string{"/engineering"},
+			opts:   GroupMembersOptions{IncludeSubgroupMembers: true},
+			want:   []string{"eng@example.com", "platform@example.com", "platform-admin@example.com"},
+		},
+		"Name": {
+			reason: "A group found by name should be read again for all of its subgroups, the search only inlining those leading to a match",
+			groups: []string{"engineering"},
+			opts:   GroupMembersOptions{IncludeSubgroupMembers: true},
+			want:   []string{"eng@example.com", "platform@example.com", "platform-admin@example.com"},
+		},
+		"Selector": {
+			reason: "A group picked by a selector should be read again for all of its subgroups",
+			opts:   GroupMembersOptions{Selectors: []GroupSelector{{Regex: "^plat.*$"}}, IncludeSubgroupMembers: true},
+			want:   []string{"platform@example.com", "platform-admin@example.com"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeKeycloak()
+			fake.legacy = true
+			srv := fake.server(t)
+			k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"})
+
+			result, err := k.GetGroupMembers(context.Background(), "", tc.groups, tc.opts)
+			if err != nil {
+				t.Fatalf("%s\nk.GetGroupMembers(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, lo.Map(result.Members, func(u User, _ int) string { return u.Email })); diff != "" {
+				t.Errorf("%s\nk.GetGroupMembers(...): -want members, +got members:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+// users returns the emails of the members of the large group in [from, to).
+func users(from, to int) []string {
+	out := []string{}
+	for i := from; i < to; i++ {
+		out = append(out, fmt.Sprintf("user%03d@example.com", i))
+	}
+	return out
+}
+
+func TestGetGroupMembersSharesConcurrentRequests(t *testing.T) {
+	fake := newFakeKeycloak()
+	fake.delay = 20 * time.Millisecond
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"}, WithParallelism(2))
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := k.GetGroupMembers(context.Background(), "", []string{"/engineering", "/sales"}, GroupMembersOptions{}); err != nil {
+				t.Errorf("k.GetGroupMembers(...): %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, r := range []struct{ method, path string }{
+		{http.MethodPost, "/realms/platform/protocol/openid-connect/token"},
+		{http.MethodGet, "/admin/realms/platform/groups/" + groupEngineering + "/members"},
+		{http.MethodGet, "/admin/realms/platform/groups/" + groupSales + "/members"},
+	} {
+		if got := fake.requests(r.method, r.path); got != 1 {
+			t.Errorf("concurrent lookups should share one request to %s, got %d", r.path, got)
+		}
+	}
+}
+
+func TestGetGroupMembersOutlivesCanceledCaller(t *testing.T) {
+	fake := newFakeKeycloak()
+	fake.delay = 100 * time.Millisecond
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"})
+
+	// The first caller starts the shared login and fetches, then gives up
+	// while they are still running.
+	first := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+		defer cancel()
+		_, err := k.GetGroupMembers(ctx, "", []string{"/engineering"}, GroupMembersOptions{})
+		first <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	result, err := k.GetGroupMembers(context.Background(), "", []string{"/engineering"}, GroupMembersOptions{})
+	if err != nil {
+		t.Fatalf("k.GetGroupMembers(...): a caller sharing the fetches of a canceled one should not fail, got %v", err)
+	}
+	if diff := cmp.Diff([]string{"eng@example.com"}, lo.Map(result.Members, func(u User, _ int) string { return u.Email })); diff != "" {
+		t.Errorf("k.GetGroupMembers(...): -want members, +got members:\n%s", diff)
+	}
+	if err := <-first; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("k.GetGroupMembers(...): the canceled caller should stop waiting with its own error, got %v", err)
+	}
+	if got := fake.requests(http.MethodPost, "/realms/platform/protocol/openid-connect/token"); got != 1 {
+		t.Errorf("both callers should share one login, got %d", got)
+	}
+}
+
+func TestGetGroupMembersStopsWithLastCaller(t *testing.T) {
+	fake := newFakeKeycloak()
+	fake.delay = 100 * time.Millisecond
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"})
+
+	// The only caller gives up during the login, so the shared fetches
+	// waiting for the token should stop rather than query Keycloak.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := k.GetGroupMembers(ctx, "", []string{"/engineering"}, GroupMembersOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("k.GetGroupMembers(...): want %v, got %v", context.DeadlineExceeded, err)
+	}
+	time.Sleep(3 * fake.delay)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for r, n := range fake.hits {
+		if strings.HasPrefix(r, http.MethodGet+" /admin/") {
+			t.Errorf("fetches left by every caller should stop, got %d requests to %s", n, r)
+		}
+	}
+}
+
+func TestGetTokenOutlivesCanceledCaller(t *testing.T) {
+	fake := newFakeKeycloak()
+	fake.delay = 100 * time.Millisecond
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	first := make(chan error, 1)
+	go func() {
+		_, err := k.GetToken(ctx)
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := k.GetToken(context.Background()); err != nil {
+		t.Fatalf("k.GetToken(...): a caller sharing the login of a canceled one should not fail, got %v", err)
+	}
+	if err := <-first; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("k.GetToken(...): the canceled caller should stop waiting with its own error, got %v", err)
+	}
+	if got := fake.requests(http.MethodPost, "/realms/platform/protocol/openid-connect/token"); got != 1 {
+		t.Errorf("both callers should share one login, got %d", got)
+	}
+}
+
+func TestGetTokenStopsWithLastCaller(t *testing.T) {
+	fake := newFakeKeycloak()
+	fake.delay = 100 * time.Millisecond
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"}).(*KeycloakClient)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := k.GetToken(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("k.GetToken(...): want %v, got %v", context.DeadlineExceeded, err)
+	}
+	time.Sleep(3 * fake.delay)
+
+	k.tokenMu.Lock()
+	defer k.tokenMu.Unlock()
+	if k.token != nil {
+		t.Errorf("a login left by every caller should stop, got token %s", k.token.access)
+	}
+}
+
+func TestGetToken(t *testing.T) {
+	type args struct {
+		refreshExpiresIn int
+		// elapsed is how long after the first login the token is asked for
+		// again.
+		elapsed time.Duration
+	}
+	type want struct {
+		token  string
+		grants map[string]int
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"ReusedBeforeExpiry": {
+			reason: "The token should be reused while it is not about to expire",
+			args: args{
+				elapsed: 260 * time.Second,
+			},
+			want: want{
+				token:  "token-1",
+				grants: map[string]int{"client_credentials": 1},
+			},
+		},
+		"RenewedBeforeExpiry": {
+			reason: "The token should be renewed once it is within the skew of its expiry",
+			args: args{
+				elapsed: 280 * time.Second,
+			},
+			want: want{
+				token:  "token-2",
+				grants: map[string]int{"client_credentials": 2},
+			},
+		},
+		"RenewedWithRefreshToken": {
+			reason: "An expired token should be renewed with a valid refresh token",
+			args: args{
+				refreshExpiresIn: 1800,
+				elapsed:          280 * time.Second,
+			},
+			want: want{
+				token:  "token-2",
+				grants: map[string]int{"client_credentials": 1, "refresh_token": 1},
+			},
+		},
+		"LoginAfterRefreshTokenExpiry": {
+			reason: "The client should log in again once the refresh token expired too",
+			args: args{
+				refreshExpiresIn: 600,
+				elapsed:          600 * time.Second,
+			},
+			want: want{
+				token:  "token-2",
+				grants: map[string]int{"client_credentials": 2},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeKeycloak()
+			fake.refreshExpiresIn = tc.args.refreshExpiresIn
+			srv := fake.server(t)
+			k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"}).(*KeycloakClient)
+			start := time.Now()
+			k.now = func() time.Time { return start }
+
+			if _, err := k.GetToken(context.Background()); err != nil {
+				t.Fatalf("k.GetToken(...): %v", err)
+			}
+			k.now = func() time.Time { return start.Add(tc.args.elapsed) }
+			token, err := k.GetToken(context.Background())
+			if err != nil {
+				t.Fatalf("k.GetToken(...): %v", err)
+			}
+
+			if diff := cmp.Diff(tc.want.token, token); diff != "" {
+				t.Errorf("%s\nk.GetToken(...): -want, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.grants, fake.grants); diff != "" {
+				t.Errorf("%s\nk.GetToken(...): -want grants, +got grants:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestGetGroupMembersRetriesRejectedToken(t *testing.T) {
+	fake := newFakeKeycloak()
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"})
+
+	if _, err := k.GetToken(context.Background()); err != nil {
+		t.Fatalf("k.GetToken(...): %v", err)
+	}
+	fake.mu.Lock()
+	fake.revoked["token-1"] = true
+	fake.mu.Unlock()
+
+	result, err := k.GetGroupMembers(context.Background(), "", []string{"/sales"}, GroupMembersOptions{})
+	if err != nil {
+		t.Fatalf("a rejected token should be replaced and the request retried, got %v", err)
+	}
+	if diff := cmp.Diff([]string{"sales@example.com"}, lo.Map(result.Members, func(u User, _ int) string { return u.Email })); diff != "" {
+		t.Errorf("k.GetGroupMembers(...): -want, +got:\n%s", diff)
+	}
+	if got := fake.grants["client_credentials"]; got != 2 {
+		t.Errorf("a rejected token should cause one new login, got %d logins", got)
+	}
+}
+
+func TestGetGroupMembersRetries(t *testing.T) {
+	type args struct {
+		failures   int
+		retryAfter string
+		clientOpts []Option
+	}
+	type want struct {
+		members []string
+		// minElapsed is the shortest time the call may take.
+		minElapsed time.Duration
+		err        error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"RetriesServerErrors": {
+			reason: "Reads failing with a server error should be retried",
+			args: args{
+				failures:   2,
+				clientOpts: []Option{WithRetryWait(time.Millisecond, 10*time.Millisecond)},
+			},
+			want: want{
+				members: []string{"sales@example.com"},
+			},
+		},
+		"HonorsRetryAfter": {
+			reason: "The Retry-After header should set the wait before the next attempt",
+			args: args{
+				failures:   1,
+				retryAfter: "1",
+				clientOpts: []Option{WithRetryWait(time.Millisecond, 2*time.Second)},
+			},
+			want: want{
+				members:    []string{"sales@example.com"},
+				minElapsed: time.Second,
+			},
+		},
+		"GivesUp": {
+			reason: "A Keycloak that keeps failing should be reported as unavailable once the retries are spent",
+			args: args{
+				failures:   3,
+				clientOpts: []Option{WithRetries(2), WithRetryWait(time.Millisecond, 10*time.Millisecond)},
+			},
+			want: want{
+				err: ErrUnavailable,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeKeycloak()
+			fake.failures = tc.args.failures
+			fake.retryAfter = tc.args.retryAfter
+			srv := fake.server(t)
+			k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"}, tc.args.clientOpts...)
+
+			start := time.Now()
+			result, err := k.GetGroupMembers(context.Background(), "", []string{"/sales"}, GroupMembersOptions{})
+			elapsed := time.Since(start)
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nk.GetGroupMembers(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(tc.want.members, lo.Map(result.Members, func(u User, _ int) string { return u.Email })); diff != "" {
+				t.Errorf("%s\nk.GetGroupMembers(...): -want, +got:\n%s", tc.reason, diff)
+			}
+			if elapsed < tc.want.minElapsed {
+				t.Errorf("%s\nk.GetGroupMembers(...): took %s, want at least %s", tc.reason, elapsed, tc.want.minElapsed)
+			}
+		})
+	}
+}
+
+func TestGetGroupMembersCircuitBreaker(t *testing.T) {
+	fake := newFakeKeycloak()
+	fake.failures = 2
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"},
+		WithRetries(0), WithCircuitBreaker(2, time.Minute)).(*KeycloakClient)
+	start := time.Now()
+	k.now = func() time.Time { return start }
+
+	get := func() error {
+		_, err := k.GetGroupMembers(context.Background(), "", []string{"/sales"}, GroupMembersOptions{})
+		return err
+	}
+
+	for range 2 {
+		if err := get(); !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("a failing Keycloak should be reported as unavailable, got %v", err)
+		}
+	}
+	before := fake.requests("GET", "/admin/realms/platform/group-by-path/sales")
+	if err := get(); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("an open circuit breaker should report Keycloak as unavailable, got %v", err)
+	}
+	if got := fake.requests("GET", "/admin/realms/platform/group-by-path/sales"); got != before {
+		t.Errorf("an open circuit breaker should not send requests, got %d new requests", got-before)
+	}
+
+	k.now = func() time.Time { return start.Add(time.Minute) }
+	if err := get(); err != nil {
+		t.Errorf("requests should be sent again after the cooldown, got %v", err)
+	}
+}
+
+func TestGetGroupMembersUnavailable(t *testing.T) {
+	unreadable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/protocol/openid-connect/token") {
+			_, _ = w.Write([]byte(`{"access_token":"token","expires_in":300}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"not":"a group"`))
+	}))
+	t.Cleanup(unreadable.Close)
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	cases := map[string]struct {
+		reason      string
+		url         string
+		unavailable bool
+	}{
+		"NoResponse": {
+			reason:      "Keycloak not answering should be reported as unavailable",
+			url:         unreachable.URL,
+			unavailable: true,
+		},
+		"UnreadableAnswer": {
+			reason: "An answer the client cannot read should not be blamed on Keycloak being down",
+			url:    unreadable.URL,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			k := NewKeycloakClient(Config{Url: tc.url, Realm: "platform", ClientId: "test", ClientSecret: "secret"},
+				WithRetries(0)).(*KeycloakClient)
+			_, err := k.GetGroupMembers(context.Background(), "", []string{"/sales"}, GroupMembersOptions{})
+			if err == nil {
+				t.Fatalf("%s\nk.GetGroupMembers(...): want error, got nil", tc.reason)
+			}
+			if got := errors.Is(err, ErrUnavailable); got != tc.unavailable {
+				t.Errorf("%s\nk.GetGroupMembers(...): want unavailable %t, got %t: %v", tc.reason, tc.unavailable, got, err)
+			}
+			if got := k.breaker.failures > 0; got != tc.unavailable {
+				t.Errorf("%s\nk.GetGroupMembers(...): want the failure counted by the breaker %t, got %t", tc.reason, tc.unavailable, got)
+			}
+		})
+	}
+}
+
+func TestGetGroupMembersServesStale(t *testing.T) {
+	fake := newFakeKeycloak()
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"},
+		WithRetries(0), WithCircuitBreaker(5, 10*time.Millisecond), WithMaxStaleness(time.Hour)).(*KeycloakClient)
+	var (
+		clockMu sync.Mutex
+		clock   = time.Now()
+	)
+	k.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return clock
+	}
+	setClock := func(d time.Duration) {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		clock = clock.Add(d)
+	}
+	setFailures := func(n int) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		fake.failures = n
+	}
+	get := func() (*GroupMembersResult, error) {
+		return k.GetGroupMembers(context.Background(), "", []string{"/sales"}, GroupMembersOptions{})
+	}
+
+	if _, err := get(); err != nil {
+		t.Fatalf("get(): %v", err)
+	}
+
+	setClock(2 * time.Minute)
+	setFailures(1000)
+	result, err := get()
+	if err != nil {
+		t.Fatalf("expired values should be served while Keycloak is unavailable, got %v", err)
+	}
+	if diff := cmp.Diff([]string{"sales@example.com"}, lo.Map(result.Members, func(u User, _ int) string { return u.Email })); diff != "" {
+		t.Errorf("get(): -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"Keycloak is unavailable, returning data cached 2m0s ago"}, result.Warnings); diff != "" {
+		t.Errorf("get(): -want warnings, +got warnings:\n%s", diff)
+	}
+
+	// Once Keycloak is back the stale values are refreshed in the background.
+	setFailures(0)
+	fresh := func() bool {
+		for _, key := range k.cacheGroup.Keys() {
+			if e, _ := k.cacheGroup.Get(key); !k.now().Before(e.fetchedAt.Add(defaultCacheExpiration)) {
+				return false
+			}
+		}
+		for _, key := range k.cacheGroupUsers.Keys() {
+			if e, _ := k.cacheGroupUsers.Get(key); !k.now().Before(e.fetchedAt.Add(defaultCacheExpiration)) {
+				return false
+			}
+		}
+		return true
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !fresh() {
+		if time.Now().After(deadline) {
+			t.Fatal("stale values were not refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	setFailures(1000)
+	result, err = get()
+	if err != nil {
+		t.Fatalf("refreshed values should be served, got %v", err)
+	}
+	if result.Warnings != nil {
+		t.Errorf("refreshed values should not be reported as stale, got %v", result.Warnings)
+	}
+
+	setClock(2 * time.Hour)
+	if _, err := get(); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("values past the maximum staleness should not be served, got %v", err)
+	}
+}
+
+func TestGetGroupMembersReportsDerivedStale(t *testing.T) {
+	fake := newFakeKeycloak()
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"},
+		WithRetries(0), WithCircuitBreaker(100, 10*time.Millisecond), WithMaxStaleness(time.Hour)).(*KeycloakClient)
+	var (
+		clockMu sync.Mutex
+		clock   = time.Now()
+	)
+	k.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return clock
+	}
+	get := func() (*GroupMembersResult, error) {
+		return k.GetGroupMembers(context.Background(), "", []string{"sales"}, GroupMembersOptions{})
+	}
+	if _, err := get(); err != nil {
+		t.Fatalf("get(): %v", err)
+	}
+	fetchedAt := k.now()
+
+	// Only the lookup of the group by name is left stale: the reference
+	// built from it is dropped, and the members are fresh.
+	clockMu.Lock()
+	clock = clock.Add(2 * time.Minute)
+	clockMu.Unlock()
+	refKey := k.cacheKey("platform", "group-ref", "sales")
+	k.cacheGroup.Delete(refKey)
+	for _, key := range k.cacheGroupUsers.Keys() {
+		e, _ := k.cacheGroupUsers.Get(key)
+		e.fetchedAt = k.now()
+		k.cacheGroupUsers.Set(key, e)
+	}
+	fake.mu.Lock()
+	fake.failures = 1000000
+	fake.delay = 50 * time.Millisecond
+	fake.mu.Unlock()
+
+	// The second caller joins the reference lookup started by the first.
+	var wg sync.WaitGroup
+	results := make([]*GroupMembersResult, 2)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if results[i], err = get(); err != nil {
+				t.Errorf("get(): %v", err)
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+	for i, result := range results {
+		if result == nil {
+			continue
+		}
+		if diff := cmp.Diff([]string{"Keycloak is unavailable, returning data cached 2m0s ago"}, result.Warnings); diff != "" {
+			t.Errorf("caller %d: -want warnings, +got warnings:\n%s", i, diff)
+		}
+	}
+
+	e, ok := k.cacheGroup.Get(refKey)
+	if !ok {
+		t.Fatal("the reference built from a stale lookup should be cached")
+	}
+	if !e.stale || !e.fetchedAt.Equal(fetchedAt) {
+		t.Errorf("the reference built from a stale lookup should be cached as read at %s, got stale %t at %s", fetchedAt, e.stale, e.fetchedAt)
+	}
+}
+
+func TestGetGroupMembersRevalidatesOnce(t *testing.T) {
+	fake := newFakeKeycloak()
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"},
+		WithRetries(0), WithCircuitBreaker(5, 10*time.Millisecond), WithMaxStaleness(time.Hour)).(*KeycloakClient)
+	var (
+		clockMu sync.Mutex
+		clock   = time.Now()
+	)
+	k.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return clock
+	}
+	get := func() (*GroupMembersResult, error) {
+		return k.GetGroupMembers(context.Background(), "", []string{"/sales"}, GroupMembersOptions{})
+	}
+	if _, err := get(); err != nil {
+		t.Fatalf("get(): %v", err)
+	}
+
+	clockMu.Lock()
+	clock = clock.Add(2 * time.Minute)
+	clockMu.Unlock()
+	fake.mu.Lock()
+	fake.failures = 1000000
+	fake.mu.Unlock()
+	t.Cleanup(func() {
+		// Let the revalidations give up.
+		clockMu.Lock()
+		clock = clock.Add(2 * time.Hour)
+		clockMu.Unlock()
+	})
+
+	before := runtime.NumGoroutine()
+	for range 50 {
+		if _, err := get(); err != nil {
+			t.Fatalf("get(): expired values should be served while Keycloak is unavailable, got %v", err)
+		}
+	}
+	// /sales has two stale values, the group and its members.
+	if got := runtime.NumGoroutine() - before; got > 5 {
+		t.Errorf("repeated lookups of stale values should start one revalidation per key, got %d more goroutines", got)
+	}
+}
+
+func TestGetRoleMembers(t *testing.T) {
+	type args struct {
+		roles []string
+		opts  RoleMembersOptions
+	}
+	type want struct {
+		members []string
+		err     error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"RealmRole": {
+			reason: "The users a realm role is mapped to should be returned",
+			args: args{
+				roles: []string{"editor"},
+			},
+			want: want{
+				members: []string{"editor@example.com"},
+			},
+		},
+		"ExpandComposites": {
+			reason: "Users holding composites that include the role should be returned too",
+			args: args{
+				roles: []string{"viewer"},
+				opts:  RoleMembersOptions{ExpandComposites: true},
+			},
+			want: want{
+				members: []string{"viewer@example.com", "editor@example.com", "admin@example.com"},
+			},
+		},
+		"IncludeGroupMembers": {
+			reason: "Members of groups holding the role, and of their subgroups, should be returned too",
+			args: args{
+				roles: []string{"viewer"},
+				opts:  RoleMembersOptions{IncludeGroupMembers: true},
+			},
+			want: want{
+				members: []string{"viewer@example.com", "sales@example.com", "sales-admin@example.com"},
+			},
+		},
+		"ClientRole": {
+			reason: "The users a client role is mapped to should be returned",
+			args: args{
+				roles: []string{"app-user"},
+				opts:  RoleMembersOptions{ClientID: "app"},
+			},
+			want: want{
+				members: []string{"app-user@example.com"},
+			},
+		},
+		"ClientRoleExpandComposites": {
+			reason: "Composite client roles and composite realm roles including a client role should be expanded",
+			args: args{
+				roles: []string{"app-user"},
+				opts:  RoleMembersOptions{ClientID: "app", ExpandComposites: true},
+			},
+			want: want{
+				members: []string{"app-user@example.com", "admin@example.com", "app-admin@example.com"},
+			},
+		},
+		"MissingRole": {
+			reason: "A role that does not exist should be reported",
+			args: args{
+				roles: []string{"missing"},
+			},
+			want: want{
+				err: errors.New("role missing not exists in realm platform"),
+			},
+		},
+		"MissingClient": {
+			reason: "A client that does not exist should be reported",
+			args: args{
+				roles: []string{"app-user"},
+				opts:  RoleMembersOptions{ClientID: "missing"},
+			},
+			want: want{
+				err: errors.New("client missing not exists in realm platform"),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := newFakeKeycloak().server(t)
+			k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"})
+
+			result, err := k.GetRoleMembers(context.Background(), "", tc.args.roles, tc.args.opts)
+			if tc.want.err != nil {
+				if diff := cmp.Diff(tc.want.err.Error(), fmt.Sprint(err)); diff != "" {
+					t.Errorf("%s\nk.GetRoleMembers(...): -want error, +got error:\n%s", tc.reason, diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nk.GetRoleMembers(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.members, lo.Map(result.Members, func(u User, _ int) string { return u.Email })); diff != "" {
+				t.Errorf("%s\nk.GetRoleMembers(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestGetRoleMembersParallelism(t *testing.T) {
+	fake := newFakeKeycloak()
+	fake.delay = 10 * time.Millisecond
+	srv := fake.server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"}, WithParallelism(2))
+
+	opts := RoleMembersOptions{ExpandComposites: true, IncludeGroupMembers: true}
+	if _, err := k.GetRoleMembers(context.Background(), "", []string{"viewer", "editor", "admin"}, opts); err != nil {
+		t.Fatalf("k.GetRoleMembers(...): %v", err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.maxInFlight > 2 {
+		t.Errorf("k.GetRoleMembers(...): want at most 2 requests in flight, got %d", fake.maxInFlight)
+	}
+}
+
+func TestGetOrganizationMembers(t *testing.T) {
+	type args struct {
+		orgs []string
+		opts OrganizationMembersOptions
+	}
+	type want struct {
+		members []string
+		domains []string
+		err     error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"ByName": {
+			reason: "The members and domains of an organization referenced by name should be returned",
+			args: args{
+				orgs: []string{"Acme Corp"},
+			},
+			want: want{
+				members: []string{"alice@acme.com", "bob@example.com"},
+				domains: []string{"acme.com", "acme.io"},
+			},
+		},
+		"ByIDAndAlias": {
+			reason: "Organizations referenced by ID or alias should be returned, domains shared by several organizations listed once",
+			args: args{
+				orgs: []string{orgAcme, "globex"},
+			},
+			want: want{
+				members: []string{"alice@acme.com", "bob@example.com", "carol@globex.com"},
+				domains: []string{"acme.com", "acme.io", "globex.com"},
+			},
+		},
+		"Managed": {
+			reason: "Only managed members should be returned when asked for",
+			args: args{
+				orgs: []string{"Acme Corp"},
+				opts: OrganizationMembersOptions{MembershipType: MembershipManaged},
+			},
+			want: want{
+				members: []string{"alice@acme.com"},
+				domains: []string{"acme.com", "acme.io"},
+			},
+		},
+		"Unmanaged": {
+			reason: "Only unmanaged members should be returned when asked for",
+			args: args{
+				orgs: []string{"Acme Corp"},
+				opts: OrganizationMembersOptions{MembershipType: MembershipUnmanaged},
+			},
+			want: want{
+				members: []string{"bob@example.com"},
+				domains: []string{"acme.com", "acme.io"},
+			},
+		},
+		"MissingOrganization": {
+			reason: "An organization that does not exist should be reported",
+			args: args{
+				orgs: []string{"Initech"},
+			},
+			want: want{
+				err: errors.New("organization Initech not exists in realm platform"),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := newFakeKeycloak().server(t)
+			k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"})
+
+			result, err := k.GetOrganizationMembers(context.Background(), "", tc.args.orgs, tc.args.opts)
+			if tc.want.err != nil {
+				if diff := cmp.Diff(tc.want.err.Error(), fmt.Sprint(err)); diff != "" {
+					t.Errorf("%s\nk.GetOrganizationMembers(...): -want error, +got error:\n%s", tc.reason, diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nk.GetOrganizationMembers(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.members, lo.Map(result.Members, func(u User, _ int) string { return u.Email })); diff != "" {
+				t.Errorf("%s\nk.GetOrganizationMembers(...): -want members, +got members:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.domains, result.Domains); diff != "" {
+				t.Errorf("%s\nk.GetOrganizationMembers(...): -want domains, +got domains:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestGetUserMemberships(t *testing.T) {
+	type args struct {
+		users []string
+		opts  UserMembershipsOptions
+	}
+	type want struct {
+		memberships map[string]UserMemberships
+		missing     []string
+		err         error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"ByEmail": {
+			reason: "The groups of a user and the realm roles they inherit from an ancestor group should be returned",
+			args: args{
+				users: []string{"sales-admin@example.com"},
+			},
+			want: want{
+				memberships: map[string]UserMemberships{
+					"sales-admin@example.com": {
+						User:        User{ID: "sales-admin@example.com", Username: "sales-admin@example.com", Email: "sales-admin@example.com"},
+						Groups:      []string{"/sales/admins"},
+						RealmRoles:  []string{"viewer"},
+						ClientRoles: map[string][]string{},
+					},
+				},
+			},
+		},
+		"ByUsername": {
+			reason: "Roles included by composite roles should be returned, realm and client roles apart",
+			args: args{
+				users: []string{"pat", "admin@example.com"},
+				opts:  UserMembershipsOptions{ClientIDs: []string{"app"}},
+			},
+			want: want{
+				memberships: map[string]UserMemberships{
+					"pat": {
+						User:        User{ID: userPat, Username: "pat", Email: "pat@example.com", Enabled: true},
+						Groups:      []string{},
+						RealmRoles:  []string{},
+						ClientRoles: map[string][]string{"app": {}},
+					},
+					"admin@example.com": {
+						User:        User{ID: "admin@example.com", Username: "admin@example.com", Email: "admin@example.com"},
+						Groups:      []string{},
+						RealmRoles:  []string{"admin", "editor", "viewer"},
+						ClientRoles: map[string][]string{"app": {"app-user"}},
+					},
+				},
+			},
+		},
+		"ByID": {
+			reason: "Users referenced by ID should be returned, missing users reported apart",
+			args: args{
+				users: []string{userPat, "nobody@example.com"},
+			},
+			want: want{
+				memberships: map[string]UserMemberships{
+					userPat: {
+						User:        User{ID: userPat, Username: "pat", Email: "pat@example.com", Enabled: true},
+						Groups:      []string{},
+						RealmRoles:  []string{},
+						ClientRoles: map[string][]string{},
+					},
+				},
+				missing: []string{"nobody@example.com"},
+			},
+		},
+		"MissingClient": {
+			reason: "A client that does not exist should be reported",
+			args: args{
+				users: []string{"pat"},
+				opts:  UserMembershipsOptions{ClientIDs: []string{"missing"}},
+			},
+			want: want{
+				err: errors.New("client missing not exists in realm platform"),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := newFakeKeycloak().server(t)
+			k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"})
+
+			result, err := k.GetUserMemberships(context.Background(), "", tc.args.users, tc.args.opts)
+			if tc.want.err != nil {
+				if diff := cmp.Diff(tc.want.err.Error(), fmt.Sprint(err)); diff != "" {
+					t.Errorf("%s\nk.GetUserMemberships(...): -want error, +got error:\n%s", tc.reason, diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nk.GetUserMemberships(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.memberships, result.Memberships); diff != "" {
+				t.Errorf("%s\nk.GetUserMemberships(...): -want memberships, +got memberships:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.missing, result.Missing); diff != "" {
+				t.Errorf("%s\nk.GetUserMemberships(...): -want missing, +got missing:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	srv := newFakeKeycloak().server(t)
+	k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"})
+
+	result, err := k.GetUsers(context.Background(), "", []string{"pat@example.com", userPat, "eng@example.com", "nobody@example.com"})
+	if err != nil {
+		t.Fatalf("k.GetUsers(...): %v", err)
+	}
+	want := &UsersResult{
+		Users: map[string]User{
+			"pat@example.com": {ID: userPat, Username: "pat", Email: "pat@example.com", Enabled: true},
+			userPat:           {ID: userPat, Username: "pat", Email: "pat@example.com", Enabled: true},
+			"eng@example.com": {ID: "eng@example.com", Username: "eng@example.com", Email: "eng@example.com"},
+		},
+		Missing: []string{"nobody@example.com"},
+	}
+	if diff := cmp.Diff(want, result); diff != "" {
+		t.Errorf("k.GetUsers(...): -want, +got:\n%s", diff)
+	}
+}
+
+func TestGetGroupMembersSelectors(t *testing.T) {
+	type want struct {
+		members   []string
+		warnings  []string
+		unmatched []GroupSelector
+		err       error
+	}
+
+	cases := map[string]struct {
+		reason string
+		groups []string
+		opts   GroupMembersOptions
+		want   want
+	}{
+		"Glob": {
+			reason: "Groups whose name matches a glob should be selected wherever they are",
+			opts:   GroupMembersOptions{Selectors: []GroupSelector{{Glob: "adm*s"}}},
+			want: want{
+				members: []string{"platform-admin@example.com", "sales-admin@example.com"},
+			},
+		},
+		"NothingToSearch": {
+			reason: "A pattern whose group name holds no literal text should be refused rather than list every group",
+			opts:   GroupMembersOptions{Selectors: []GroupSelector{{Glob: "/sales/*"}}},
+			want: want{
+				err: errors.New(`group selector glob "/sales/*" has no literal text to search for`),
+			},
+		},
+		"PathGlob": {
+			reason: "Globs starting with a slash should match full group paths",
+			opts:   GroupMembersOptions{Selectors: []GroupSelector{{Glob: "/engineering/*/admins"}}},
+			want: want{
+				members: []string{"platform-admin@example.com"},
+			},
+		},
+		"Regex": {
+			reason: "Groups whose name matches a regex should be selected, with their subgroups when asked for",
+			opts:   GroupMembersOptions{Selectors: []GroupSelector{{Regex: "^plat.*$"}}, IncludeSubgroupMembers: true},
+			want: want{
+				members: []string{"platform@example.com", "platform-admin@example.com"},
+			},
+		},
+		"Attributes": {
+			reason: "Groups holding every attribute should be selected, and not again when referenced by name",
+			groups: []string{"/engineering/platform/admins"},
+			opts:   GroupMembersOptions{Selectors: []GroupSelector{{Attributes: map[string]string{"team": "platform", "access": "admin"}}}},
+			want: want{
+				members: []string{"platform-admin@example.com"},
+			},
+		},
+		"AttributesAndGlob": {
+			reason: "A group should match every field of a selector",
+			opts:   GroupMembersOptions{Selectors: []GroupSelector{{Glob: "plat*", Attributes: map[string]string{"team": "platform"}}}},
+			want: want{
+				members: []string{"platform@example.com"},
+			},
+		},
+		"NoMatch": {
+			reason: "A selector matching no group should be reported",
+			opts:   GroupMembersOptions{Selectors: []GroupSelector{{Glob: "marketing-*"}}},
+			want: want{
+				members:   []string{},
+				unmatched: []GroupSelector{{Glob: "marketing-*"}},
+			},
+		},
+		"InvalidRegex": {
+			reason: "An invalid regex should be reported",
+			opts:   GroupMembersOptions{Selectors: []GroupSelector{{Regex: "team-("}}},
+			want: want{
+				err: errors.New("invalid group selector regex \"team-(\": error parsing regexp: missing closing ): `team-(`"),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeKeycloak()
+			srv := fake.server(t)
+			k := NewKeycloakClient(Config{Url: srv.URL, Realm: "platform", ClientId: "test", ClientSecret: "secret"})
+
+			result, err := k.GetGroupMembers(context.Background(), "", tc.groups, tc.opts)
+			if tc.want.err != nil {
+				if diff := cmp.Diff(tc.want.err.Error(), fmt.Sprint(err)); diff != "" {
+					t.Errorf("%s\nk.GetGroupMembers(...): -want error, +got error:\n%s", tc.reason, diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nk.GetGroupMembers(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.members, lo.Map(result.Members, func(u User, _ int) string { return u.Email })); diff != "" {
+				t.Errorf("%s\nk.GetGroupMembers(...): -want members, +got members:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.warnings, result.Warnings); diff != "" {
+				t.Errorf("%s\nk.GetGroupMembers(...): -want warnings, +got warnings:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.unmatched, result.Unmatched); diff != "" {
+				t.Errorf("%s\nk.GetGroupMembers(...): -want unmatched selectors, +got unmatched selectors:\n%s", tc.reason, diff)
+			}
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if fake.listings > 0 {
+				t.Errorf("%s\nk.GetGroupMembers(...): listed every group %d times, want searches only", tc.reason, fake.listings)
+			}
+		})
+	}
+}
+
+func TestPoolKeepsClientsPerSecret(t *testing.T) {
+	closed := map[string]bool{}
+	p := NewPool(func(cfg Config) KeycloakClientInterface {
+		return &closeRecorder{name: cfg.ClientSecret, closed: closed}
+	})
+	clock := time.Now()
+	p.now = func() time.Time { return clock }
+
+	old := p.Get(Config{Url: "https://keycloak.example.com", Realm: "platform", ClientId: "test", ClientSecret: "old"})
+	rotated := p.Get(Config{Url: "https://keycloak.example.com", Realm: "platform", ClientId: "test", ClientSecret: "new"})
+	if old == rotated {
+		t.Fatal("p.Get(...): a rotated secret should get a client of its own")
+	}
+	if got := p.Get(Config{Url: "https://keycloak.example.com", Realm: "platform", ClientId: "test", ClientSecret: "old"}); got != old {
+		t.Error("p.Get(...): a request still using the old secret should keep its client")
+	}
+	if len(closed) > 0 {
+		t.Errorf("p.Get(...): rotating the secret should not close clients in use, closed %v", closed)
+	}
+
+	clock = clock.Add(30 * time.Minute)
+	p.Get(Config{Url: "https://keycloak.example.com", Realm: "platform", ClientId: "test", ClientSecret: "new"})
+	clock = clock.Add(30 * time.Minute)
+	p.Get(Config{Url: "https://keycloak.example.com", Realm: "platform", ClientId: "test", ClientSecret: "new"})
+
+	if diff := cmp.Diff(map[string]bool{"old": true}, closed); diff != "" {
+		t.Errorf("p.Get(...): -want closed clients, +got closed clients:\n%s", diff)
+	}
+}
+
+func TestPoolClosesEvictedClients(t *testing.T) {
+	p := NewPool(func(cfg Config) KeycloakClientInterface { return NewKeycloakClient(cfg) })
+	clock := time.Now()
+	p.now = func() time.Time { return clock }
+	// Let the janitors of the first client start before counting.
+	p.Get(Config{Url: "https://keycloak.example.com", Realm: "platform", ClientId: "test", ClientSecret: "secret-0"})
+	time.Sleep(10 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	for i := range 10 {
+		p.Get(Config{Url: "https://keycloak.example.com", Realm: "platform", ClientId: "test", ClientSecret: fmt.Sprintf("secret-%d", i+1)})
+	}
+	clock = clock.Add(defaultPoolIdleTimeout)
+	p.Get(Config{Url: "https://keycloak.example.com", Realm: "platform", ClientId: "test", ClientSecret: "secret-0"})
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine() - before; got > 0 {
+		t.Errorf("evicting idle clients should stop their goroutines, got %d more goroutines", got)
+	}
+	if got := len(p.clients); got != 1 {
+		t.Errorf("evicting idle clients should keep only the client in use, got %d", got)
+	}
+}
+
+func TestPoolEvictsIdleClients(t *testing.T) {
+	closed := map[string]bool{}
+	p := NewPool(func(cfg Config) KeycloakClientInterface { return &closeRecorder{name: cfg.Realm, closed: closed} })
+	clock := time.Now()
+	p.now = func() time.Time { return clock }
+
+	p.Get(Config{Url: "https://keycloak.example.com", Realm: "idle", ClientId: "test"})
+	clock = clock.Add(30 * time.Minute)
+	p.Get(Config{Url: "https://keycloak.example.com", Realm: "busy", ClientId: "test"})
+	clock = clock.Add(30 * time.Minute)
+	p.Get(Config{Url: "https://keycloak.example.com", Realm: "busy", ClientId: "test"})
+
+	if diff := cmp.Diff(map[string]bool{"idle": true}, closed); diff != "" {
+		t.Errorf("p.Get(...): -want closed clients, +got closed clients:\n%s", diff)
+	}
+	if got := len(p.clients); got != 1 {
+		t.Errorf("p.Get(...): idle clients should be dropped from the pool, got %d pooled clients", got)
+	}
+}
+
+// closeRecorder is a client that records being closed.
+type closeRecorder struct {
+	KeycloakClientInterface
+	name   string
+	closed map[string]bool
+}
+
+func (c *closeRecorder) Close() {
+	c.closed[c.name] = true
+}
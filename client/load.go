@@ -0,0 +1,220 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	cache "github.com/Code-Hex/go-generics-cache"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultParallelism = 4
+	// revalidateTimeout bounds a single background refresh of a stale value.
+	revalidateTimeout = 30 * time.Second
+)
+
+// entry is a cached value along with when it was read from Keycloak.
+type entry[V any] struct {
+	value     V
+	fetchedAt time.Time
+	// stale is set when the value was built from stale values, fetchedAt
+	// then being when the oldest of them was read.
+	stale bool
+}
+
+// load returns the cached value for key. On a miss, concurrent callers asking
+// for the same key share a single call to fetch, whose result is cached for
+// ttl. A caller whose context ends stops waiting, the fetch carries on for the
+// others.
+//
+// When Keycloak is unavailable, an expired value is returned for up to
+// k.maxStaleness past its ttl. It is reported on the context and refreshed
+// in the background.
+func load[V any](ctx context.Context, k *KeycloakClient, c *cache.Cache[string, entry[V]], key string, ttl time.Duration, fetch func(ctx context.Context) (V, error)) (V, error) {
+	e, cached := c.Get(key)
+	if cached && k.now().Before(e.fetchedAt.Add(ttl)) {
+		if e.stale {
+			reportStale(ctx, e.fetchedAt)
+		}
+		return e.value, nil
+	}
+
+	v, err := refresh(ctx, k, c, key, ttl, fetch)
+	if err == nil || !cached || !errors.Is(err, ErrUnavailable) || !k.now().Before(e.fetchedAt.Add(ttl+k.maxStaleness)) {
+		return v, err
+	}
+	reportStale(ctx, e.fetchedAt)
+	if _, running := k.revalidating.LoadOrStore(key, true); !running {
+		go revalidate(k, c, key, ttl, e.fetchedAt.Add(ttl+k.maxStaleness), fetch)
+	}
+	return e.value, nil
+}
+
+// refresh calls fetch, shared with concurrent callers asking for the same key,
+// and caches the result. The fetch runs until the last caller waiting for it
+// gives up, so the caller that started it ending only stops it from waiting.
+//
+// A value built from stale values is cached as read when the oldest of them
+// was, and reported as stale to every caller waiting for it.
+func refresh[V any](ctx context.Context, k *KeycloakClient, c *cache.Cache[string, entry[V]], key string, ttl time.Duration, fetch func(ctx context.Context) (V, error)) (V, error) {
+	res, err := k.shared.do(ctx, key, func(ctx context.Context) (any, error) {
+		ctx, stale := withStaleReport(ctx)
+		v, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		e := entry[V]{value: v, fetchedAt: k.now()}
+		if since, ok := stale.since(); ok {
+			e.fetchedAt, e.stale = since, true
+		}
+		c.Set(key, e, cache.WithExpiration(ttl+k.maxStaleness))
+		return e, nil
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	e := res.(entry[V])
+	if e.stale {
+		reportStale(ctx, e.fetchedAt)
+	}
+	return e.value, nil
+}
+
+// sharedCalls runs work shared by concurrent callers asking for the same key.
+// Unlike singleflight, the work is canceled once every caller waiting for it
+// gave up, so it never outlives the deadlines of its callers.
+type sharedCalls struct {
+	mu    sync.Mutex
+	calls map[string]*sharedCall
+}
+
+type sharedCall struct {
+	waiters int
+	cancel  context.CancelFunc
+	done    chan struct{}
+	val     any
+	err     error
+}
+
+// do calls fn once for the concurrent callers asking for key and returns its
+// result. fn gets a context keeping the values of the ctx of the caller that
+// started it, and canceled when the last caller waiting for it stops.
+func (s *sharedCalls) do(ctx context.Context, key string, fn func(ctx context.Context) (any, error)) (any, error) {
+	s.mu.Lock()
+	if s.calls == nil {
+		s.calls = map[string]*sharedCall{}
+	}
+	c, ok := s.calls[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &sharedCall{cancel: cancel, done: make(chan struct{})}
+		s.calls[key] = c
+		go func() {
+			defer cancel()
+			c.val, c.err = fn(fctx)
+			s.mu.Lock()
+			if s.calls[key] == c {
+				delete(s.calls, key)
+			}
+			s.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	s.mu.Unlock()
+
+	select {
+	case <-c.done:
+		s.mu.Lock()
+		c.waiters--
+		s.mu.Unlock()
+		return c.val, c.err
+	case <-ctx.Done():
+		s.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Later callers start over rather than joining a canceled call.
+			c.cancel()
+			if s.calls[key] == c {
+				delete(s.calls, key)
+			}
+		}
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// revalidate retries fetching key once per circuit breaker cooldown until it
+// gets a value not built from stale ones, the stale value expires or the
+// client is closed. load only starts
+// it for keys not in k.revalidating, so one revalidation runs per key.
+func revalidate[V any](k *KeycloakClient, c *cache.Cache[string, entry[V]], key string, ttl time.Duration, until time.Time, fetch func(ctx context.Context) (V, error)) {
+	defer k.revalidating.Delete(key)
+	for k.now().Before(until) {
+		select {
+		case <-k.ctx.Done():
+			return
+		case <-time.After(k.breaker.cooldown):
+		}
+		ctx, cancel := context.WithTimeout(k.ctx, revalidateTimeout)
+		ctx, stale := withStaleReport(ctx)
+		_, err := refresh(ctx, k, c, key, ttl, fetch)
+		cancel()
+		if _, ok := stale.since(); err == nil && !ok {
+			return
+		}
+	}
+}
+
+type staleKey struct{}
+
+// staleReport records the oldest stale value served to a lookup.
+type staleReport struct {
+	mu     sync.Mutex
+	oldest time.Time
+}
+
+// withStaleReport returns a context on which load reports the stale values it
+// serves.
+func withStaleReport(ctx context.Context) (context.Context, *staleReport) {
+	r := &staleReport{}
+	return context.WithValue(ctx, staleKey{}, r), r
+}
+
+func reportStale(ctx context.Context, fetchedAt time.Time) {
+	r, ok := ctx.Value(staleKey{}).(*staleReport)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.oldest.IsZero() || fetchedAt.Before(r.oldest) {
+		r.oldest = fetchedAt
+	}
+}
+
+// since returns when the oldest stale value was read, or false if none was
+// served.
+func (r *staleReport) since() (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.oldest, !r.oldest.IsZero()
+}
+
+// forEach calls fn for every index in [0, n) with at most k.parallelism calls
+// in flight, and returns the first error. The context passed to fn is
+// canceled once any call fails.
+func (k *KeycloakClient) forEach(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(k.parallelism)
+	for i := range n {
+		g.Go(func() error {
+			return fn(gctx, i)
+		})
+	}
+	return g.Wait()
+}
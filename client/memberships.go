@@ -0,0 +1,199 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+	"github.com/samber/lo"
+)
+
+// UserMembershipsOptions tunes how GetUserMemberships resolves users.
+type UserMembershipsOptions struct {
+	// ClientIDs are the clientIds of the clients whose effective roles are
+	// returned along with the realm roles.
+	ClientIDs []string
+}
+
+// UserMemberships is what a user belongs to.
+type UserMemberships struct {
+	User User
+	// Groups holds the paths of the groups the user is a direct member of.
+	Groups []string
+	// RealmRoles holds the names of the user's effective realm roles, be
+	// they mapped to the user, to one of their groups or included by a
+	// composite role.
+	RealmRoles []string
+	// ClientRoles maps each requested clientId to the names of the user's
+	// effective roles of that client.
+	ClientRoles map[string][]string
+}
+
+// UserMembershipsResult is what GetUserMemberships found.
+type UserMembershipsResult struct {
+	// Memberships are keyed by the user reference they were asked for.
+	// Users that do not exist are left out.
+	Memberships map[string]UserMemberships
+	// Missing lists the references no user was found for.
+	Missing []string
+	// Warnings describe listings that were cut off by the result cap.
+	Warnings []string
+}
+
+// GetUserMemberships returns the groups and effective roles of the referenced
+// users in realm. An empty realm queries the realm the client logs in to.
+// Users are referenced by ID, username or email.
+func (k *KeycloakClient) GetUserMemberships(ctx context.Context, realm string, userRefs []string, opts UserMembershipsOptions) (*UserMembershipsResult, error) {
+	if realm == "" {
+		realm = k.Realm
+	}
+	ctx, stale := withStaleReport(ctx)
+
+	clients := make([]*gocloak.Client, len(opts.ClientIDs))
+	err := k.forEach(ctx, len(opts.ClientIDs), func(ctx context.Context, i int) error {
+		c, err := k.client(ctx, realm, opts.ClientIDs[i])
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			return fmt.Errorf("client %s not exists in realm %s", opts.ClientIDs[i], realm)
+		}
+		clients[i] = c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]*UserMemberships, len(userRefs))
+	truncated := make([]bool, len(userRefs))
+	err = k.forEach(ctx, len(userRefs), func(ctx context.Context, i int) error {
+		user, err := k.resolveUser(ctx, realm, userRefs[i])
+		if err != nil || user == nil {
+			return err
+		}
+		groups, err := k.userGroups(ctx, realm, gocloak.PString(user.ID))
+		if err != nil {
+			return err
+		}
+		truncated[i] = groups.Truncated
+
+		m := &UserMemberships{
+			User:        newUser(user),
+			Groups:      lo.Map(groups.Items, func(g *gocloak.Group, _ int) string { return groupLabel(g) }),
+			ClientRoles: map[string][]string{},
+		}
+		if m.RealmRoles, err = k.userRoles(ctx, realm, gocloak.PString(user.ID), ""); err != nil {
+			return err
+		}
+		for j, c := range clients {
+			if m.ClientRoles[opts.ClientIDs[j]], err = k.userRoles(ctx, realm, gocloak.PString(user.ID), gocloak.PString(c.ID)); err != nil {
+				return err
+			}
+		}
+		found[i] = m
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UserMembershipsResult{Memberships: map[string]UserMemberships{}}
+	for i, ref := range userRefs {
+		if found[i] == nil {
+			result.Missing = append(result.Missing, ref)
+			continue
+		}
+		if truncated[i] {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("user %s is a member of more than %d groups, only the first %d are returned", ref, k.maxResults, k.maxResults))
+		}
+		result.Memberships[ref] = *found[i]
+	}
+	if since, ok := stale.since(); ok {
+		result.Warnings = append(result.Warnings, k.staleWarning(since))
+	}
+	return result, nil
+}
+
+// resolveUser finds the user a reference points at. UUIDs are user IDs,
+// anything else is matched against emails when it contains an @, then against
+// usernames. A missing user resolves to nil.
+func (k *KeycloakClient) resolveUser(ctx context.Context, realm, ref string) (*gocloak.User, error) {
+	key := k.cacheKey(realm, "user-ref", ref)
+	return load(ctx, k, k.cacheUser, key, defaultCacheExpiration, func(ctx context.Context) (*gocloak.User, error) {
+		if groupIDPattern.MatchString(ref) {
+			var user *gocloak.User
+			err := k.call(ctx, func(ctx context.Context, token string) (err error) {
+				user, err = k.keycloakClient.GetUserByID(ctx, token, realm, ref)
+				return err
+			})
+			if isNotFound(err) {
+				return nil, nil
+			}
+			return user, err
+		}
+
+		var params []gocloak.GetUsersParams
+		if strings.Contains(ref, "@") {
+			params = append(params, gocloak.GetUsersParams{Email: gocloak.StringP(ref), Exact: gocloak.BoolP(true)})
+		}
+		params = append(params, gocloak.GetUsersParams{Username: gocloak.StringP(ref), Exact: gocloak.BoolP(true)})
+		for _, p := range params {
+			var users []*gocloak.User
+			err := k.call(ctx, func(ctx context.Context, token string) (err error) {
+				users, err = k.keycloakClient.GetUsers(ctx, token, realm, p)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(users) > 0 {
+				return users[0], nil
+			}
+		}
+		return nil, nil
+	})
+}
+
+// userGroups returns the groups a user is a direct member of.
+func (k *KeycloakClient) userGroups(ctx context.Context, realm, userID string) (listing[*gocloak.Group], error) {
+	key := k.cacheKey(realm, "user-groups", userID)
+	return load(ctx, k, k.cacheUserGroups, key, defaultCacheExpiration, func(ctx context.Context) (listing[*gocloak.Group], error) {
+		return listAll(k.pageSize, k.maxResults, func(first, max int) (page []*gocloak.Group, err error) {
+			err = k.call(ctx, func(ctx context.Context, token string) error {
+				page, err = k.keycloakClient.GetUserGroups(ctx, token, realm, userID, gocloak.GetGroupsParams{
+					First:               gocloak.IntP(first),
+					Max:                 gocloak.IntP(max),
+					BriefRepresentation: gocloak.BoolP(false),
+				})
+				return err
+			})
+			return page, err
+		})
+	})
+}
+
+// userRoles returns the sorted names of a user's effective realm roles, or of
+// their effective roles of the client with the supplied ID when it is set.
+func (k *KeycloakClient) userRoles(ctx context.Context, realm, userID, clientUUID string) ([]string, error) {
+	key := k.cacheKey(realm, "user-roles", userID, clientUUID)
+	return load(ctx, k, k.cacheUserRoles, key, defaultCacheExpiration, func(ctx context.Context) ([]string, error) {
+		var roles []*gocloak.Role
+		err := k.call(ctx, func(ctx context.Context, token string) (err error) {
+			if clientUUID != "" {
+				roles, err = k.keycloakClient.GetCompositeClientRolesByUserID(ctx, token, realm, clientUUID, userID)
+			} else {
+				roles, err = k.keycloakClient.GetCompositeRealmRolesByUserID(ctx, token, realm, userID)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		names := lo.Map(roles, func(r *gocloak.Role, _ int) string { return gocloak.PString(r.Name) })
+		slices.Sort(names)
+		return names, nil
+	})
+}
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+	"github.com/samber/lo"
+)
+
+// MembershipType is how a user belongs to an organization.
+type MembershipType string
+
+const (
+	// MembershipManaged members are owned by the organization, typically
+	// created through its identity provider.
+	MembershipManaged MembershipType = "MANAGED"
+	// MembershipUnmanaged members joined an organization with an existing
+	// realm account.
+	MembershipUnmanaged MembershipType = "UNMANAGED"
+)
+
+// OrganizationMembersOptions tunes how GetOrganizationMembers resolves
+// organizations.
+type OrganizationMembersOptions struct {
+	// MembershipType only returns members of that type. All members are
+	// returned when it is empty.
+	MembershipType MembershipType
+	// IncludeFederatedIdentities fills in User.FederatedIdentities, which
+	// costs one extra request per user.
+	IncludeFederatedIdentities bool
+}
+
+// OrganizationMembersResult is what GetOrganizationMembers found.
+type OrganizationMembersResult struct {
+	GroupMembersResult
+	// Domains of the organizations, each listed once.
+	Domains []string
+}
+
+// organization is the part of a Keycloak organization the client reads.
+// gocloak predates organizations, so they are read through raw requests.
+type organization struct {
+	ID      string               `json:"id"`
+	Name    string               `json:"name"`
+	Alias   string               `json:"alias"`
+	Domains []organizationDomain `json:"domains"`
+}
+
+type organizationDomain struct {
+	Name     string `json:"name"`
+	Verified bool   `json:"verified"`
+}
+
+// organizationMember is a user along with how they belong to an organization.
+type organizationMember struct {
+	gocloak.User
+	MembershipType MembershipType `json:"membershipType"`
+}
+
+// GetOrganizationMembers returns the members and domains of the referenced
+// organizations in realm. An empty realm queries the realm the client logs in
+// to. Organizations are referenced by ID, alias or name.
+func (k *KeycloakClient) GetOrganizationMembers(ctx context.Context, realm string, orgNames []string, opts OrganizationMembersOptions) (*OrganizationMembersResult, error) {
+	if realm == "" {
+		realm = k.Realm
+	}
+	ctx, stale := withStaleReport(ctx)
+
+	orgs := make([]*organization, len(orgNames))
+	members := make([]listing[organizationMember], len(orgNames))
+	err := k.forEach(ctx, len(orgNames), func(ctx context.Context, i int) error {
+		org, err := k.resolveOrganization(ctx, realm, orgNames[i])
+		if err != nil {
+			return err
+		}
+		if org == nil {
+			return fmt.Errorf("organization %s not exists in realm %s", orgNames[i], realm)
+		}
+		orgs[i] = org
+		members[i], err = k.organizationMembers(ctx, realm, org)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &OrganizationMembersResult{GroupMembersResult: GroupMembersResult{Members: []User{}}, Domains: []string{}}
+	for i, org := range orgs {
+		if members[i].Truncated {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("organization %s has more than %d members, only the first %d are returned", org.Name, k.maxResults, k.maxResults))
+		}
+		for _, m := range members[i].Items {
+			if opts.MembershipType == "" || m.MembershipType == opts.MembershipType {
+				result.Members = append(result.Members, newUser(&m.User))
+			}
+		}
+		for _, d := range org.Domains {
+			result.Domains = append(result.Domains, d.Name)
+		}
+	}
+	result.Domains = lo.Uniq(result.Domains)
+
+	if _, err := k.finish(ctx, realm, &result.GroupMembersResult, opts.IncludeFederatedIdentities, stale); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// resolveOrganization finds the organization a reference points at. UUIDs are
+// organization IDs, anything else is matched against aliases and names. A
+// missing organization resolves to nil.
+func (k *KeycloakClient) resolveOrganization(ctx context.Context, realm, ref string) (*organization, error) {
+	key := k.cacheKey(realm, "organization-ref", ref)
+	return load(ctx, k, k.cacheOrganization, key, defaultCacheExpiration, func(ctx context.Context) (*organization, error) {
+		if groupIDPattern.MatchString(ref) {
+			var org *organization
+			err := k.call(ctx, func(ctx context.Context, token string) error {
+				resp, err := k.keycloakClient.GetRequestWithBearerAuth(ctx, token).
+					SetResult(&org).
+					Get(k.adminURL(realm, "organizations", ref))
+				return checkResponse(resp, err, "could not get organization")
+			})
+			if isNotFound(err) {
+				return nil, nil
+			}
+			return org, err
+		}
+
+		return k.organizationByName(ctx, realm, ref)
+	})
+}
+
+// organizationByName returns the organization with the supplied alias, or
+// failing that name. Keycloak only searches organizations by name and domain,
+// so they are all listed.
+func (k *KeycloakClient) organizationByName(ctx context.Context, realm, name string) (*organization, error) {
+	key := k.cacheKey(realm, "organizations")
+	orgs, err := load(ctx, k, k.cacheOrganizations, key, defaultCacheExpiration, func(ctx context.Context) (listing[*organization], error) {
+		return listAll(k.pageSize, k.maxResults, func(first, max int) (page []*organization, err error) {
+			err = k.call(ctx, func(ctx context.Context, token string) error {
+				page = nil
+				resp, err := k.keycloakClient.GetRequestWithBearerAuth(ctx, token).
+					SetResult(&page).
+					SetQueryParams(map[string]string{"first": strconv.Itoa(first), "max": strconv.Itoa(max), "briefRepresentation": "false"}).
+					Get(k.adminURL(realm, "organizations"))
+				return checkResponse(resp, err, "could not get organizations")
+			})
+			return page, err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if org, ok := lo.Find(orgs.Items, func(o *organization) bool { return o.Alias == name }); ok {
+		return org, nil
+	}
+	if org, ok := lo.Find(orgs.Items, func(o *organization) bool { return o.Name == name }); ok {
+		return org, nil
+	}
+	if orgs.Truncated {
+		return nil, fmt.Errorf("organization %s not found in the first %d organizations of realm %s, reference it by ID", name, k.maxResults, realm)
+	}
+	return nil, nil
+}
+
+// organizationMembers returns the members of an organization.
+func (k *KeycloakClient) organizationMembers(ctx context.Context, realm string, org *organization) (listing[organizationMember], error) {
+	key := k.cacheKey(realm, "organization-members", org.ID)
+	return load(ctx, k, k.cacheOrgMembers, key, defaultCacheExpiration, func(ctx context.Context) (listing[organizationMember], error) {
+		return listAll(k.pageSize, k.maxResults, func(first, max int) (page []organizationMember, err error) {
+			err = k.call(ctx, func(ctx context.Context, token string) error {
+				page = nil
+				resp, err := k.keycloakClient.GetRequestWithBearerAuth(ctx, token).
+					SetResult(&page).
+					SetQueryParams(map[string]string{"first": strconv.Itoa(first), "max": strconv.Itoa(max)}).
+					Get(k.adminURL(realm, "organizations", org.ID, "members"))
+				return checkResponse(resp, err, "could not get organization members")
+			})
+			return page, err
+		})
+	})
+}
@@ -0,0 +1,39 @@
+package client
+
+const (
+	defaultPageSize   = 100
+	defaultMaxResults = 10000
+)
+
+// listing is the result of paging through a Keycloak collection.
+type listing[T any] struct {
+	Items []T
+	// Truncated is set when the collection holds more items than the
+	// client is allowed to read.
+	Truncated bool
+}
+
+// listAll calls page with increasing offsets until a short page comes back or
+// maxResults items were read. When the cap is hit it asks for one more item to
+// tell a collection of exactly maxResults items from a truncated one.
+func listAll[T any](pageSize, maxResults int, page func(first, max int) ([]T, error)) (listing[T], error) {
+	result := listing[T]{Items: []T{}}
+	for len(result.Items) < maxResults {
+		size := min(pageSize, maxResults-len(result.Items))
+		items, err := page(len(result.Items), size)
+		if err != nil {
+			return listing[T]{}, err
+		}
+		result.Items = append(result.Items, items...)
+		if len(items) < size {
+			return result, nil
+		}
+	}
+
+	extra, err := page(len(result.Items), 1)
+	if err != nil {
+		return listing[T]{}, err
+	}
+	result.Truncated = len(extra) > 0
+	return result, nil
+}
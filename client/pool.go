@@ -0,0 +1,69 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultPoolIdleTimeout is how long a pooled client is kept without being
+// used.
+const defaultPoolIdleTimeout = time.Hour
+
+// Factory builds a client for the supplied config.
+type Factory func(cfg Config) KeycloakClientInterface
+
+type pooledClient struct {
+	client   KeycloakClientInterface
+	lastUsed time.Time
+}
+
+// Pool reuses clients across requests so their token and group caches survive
+// between calls. Clients are keyed on the instance, realm, client ID and a
+// hash of the secret, so a rotated secret gets a client of its own while
+// requests still using the old one keep theirs. Clients not used for an hour
+// are closed.
+type Pool struct {
+	mu          sync.Mutex
+	factory     Factory
+	clients     map[string]*pooledClient
+	idleTimeout time.Duration
+	now         func() time.Time
+}
+
+func NewPool(factory Factory) *Pool {
+	return &Pool{
+		factory:     factory,
+		clients:     make(map[string]*pooledClient),
+		idleTimeout: defaultPoolIdleTimeout,
+		now:         time.Now,
+	}
+}
+
+// Get returns the pooled client for the config, building it if needed.
+func (p *Pool) Get(cfg Config) KeycloakClientInterface {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.evictIdle(now)
+
+	key := cfg.key()
+	if pc, ok := p.clients[key]; ok {
+		pc.lastUsed = now
+		return pc.client
+	}
+
+	c := p.factory(cfg)
+	p.clients[key] = &pooledClient{client: c, lastUsed: now}
+	return c
+}
+
+// evictIdle closes and drops the clients not used for p.idleTimeout.
+func (p *Pool) evictIdle(now time.Time) {
+	for key, pc := range p.clients {
+		if now.Sub(pc.lastUsed) >= p.idleTimeout {
+			pc.client.Close()
+			delete(p.clients, key)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultConnection is the name of the connection built from the environment.
+const DefaultConnection = "default"
+
+// Registry holds the named Keycloak connections a step can select.
+type Registry struct {
+	connections map[string]Config
+}
+
+// NewRegistry returns a registry holding only the default connection.
+func NewRegistry() *Registry {
+	return &Registry{
+		connections: map[string]Config{DefaultConnection: ConfigFromEnv()},
+	}
+}
+
+// LoadRegistry returns a registry with the default connection plus the named
+// connections in the YAML file at path. The file maps connection names to
+// url, realm, clientId and clientSecret. An empty path loads nothing.
+func LoadRegistry(path string) (*Registry, error) {
+	r := NewRegistry()
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	connections := map[string]Config{}
+	if err := yaml.Unmarshal(data, &connections); err != nil {
+		return nil, fmt.Errorf("cannot parse connections file %s: %w", path, err)
+	}
+	for name, cfg := range connections {
+		r.connections[name] = cfg
+	}
+	return r, nil
+}
+
+// Register adds or replaces the named connection.
+func (r *Registry) Register(name string, cfg Config) {
+	r.connections[name] = cfg
+}
+
+// Get returns the named connection. An empty name selects the default one.
+func (r *Registry) Get(name string) (Config, bool) {
+	if name == "" {
+		name = DefaultConnection
+	}
+	cfg, ok := r.connections[name]
+	return cfg, ok
+}
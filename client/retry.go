@@ -0,0 +1,202 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	defaultRetries          = 3
+	defaultRetryWait        = 200 * time.Millisecond
+	defaultRetryMaxWait     = 5 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// ErrUnavailable is returned when Keycloak could not be reached, answered
+// with a server error after every retry, or is skipped because the circuit
+// breaker is open.
+var ErrUnavailable = errors.New("Keycloak is unavailable")
+
+// errNoResponse marks errors of requests Keycloak never answered, telling
+// them from answers the client failed to read, which gocloak reports with
+// the same code 0.
+var errNoResponse = errors.New("no response")
+
+// WithRetries sets how many times a failed read is retried. Zero disables
+// retries.
+func WithRetries(n int) Option {
+	return func(k *KeycloakClient) {
+		if n >= 0 {
+			k.retries = n
+		}
+	}
+}
+
+// WithRetryWait sets the bounds of the exponential backoff between retries.
+// A Retry-After header sent by Keycloak is honored within the same bounds.
+func WithRetryWait(wait, maxWait time.Duration) Option {
+	return func(k *KeycloakClient) {
+		if wait > 0 && maxWait >= wait {
+			k.retryWait = wait
+			k.retryMaxWait = maxWait
+		}
+	}
+}
+
+// WithCircuitBreaker sets after how many consecutive failed requests the
+// client stops calling Keycloak, and for how long.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(k *KeycloakClient) {
+		if threshold > 0 && cooldown > 0 {
+			k.breaker.threshold = threshold
+			k.breaker.cooldown = cooldown
+		}
+	}
+}
+
+// configureRetries makes the HTTP client retry reads and logins that failed
+// with a network error, a server error or 429, backing off exponentially
+// with jitter.
+func (k *KeycloakClient) configureRetries(c *resty.Client) {
+	base := c.GetClient().Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.SetTransport(reportingTransport{base: base}).
+		SetRetryCount(k.retries).
+		SetRetryWaitTime(k.retryWait).
+		SetRetryMaxWaitTime(k.retryMaxWait).
+		SetRetryAfter(retryAfter).
+		AddRetryCondition(shouldRetry)
+}
+
+func shouldRetry(resp *resty.Response, err error) bool {
+	if resp == nil || resp.Request == nil || !idempotent(resp.Request) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode() == http.StatusTooManyRequests || resp.StatusCode() >= http.StatusInternalServerError
+}
+
+// idempotent reports whether a request can be sent again safely. Logging in
+// only issues a new token, so it is treated as a read.
+func idempotent(r *resty.Request) bool {
+	return r.Method == http.MethodGet || strings.HasSuffix(r.URL, "/protocol/openid-connect/token")
+}
+
+// retryAfter reads the Retry-After header, in seconds or as an HTTP date.
+// Zero makes resty fall back to its backoff.
+func retryAfter(_ *resty.Client, resp *resty.Response) (time.Duration, error) {
+	v := resp.Header().Get("Retry-After")
+	if v == "" {
+		return 0, nil
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second, nil
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), nil
+	}
+	return 0, nil
+}
+
+// isUnavailable reports whether err means Keycloak is down rather than that
+// the request was wrong: it sent no response, 429 or a server error.
+func isUnavailable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || err == nil {
+		return false
+	}
+	if errors.Is(err, errNoResponse) {
+		return true
+	}
+	var apiErr *gocloak.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+}
+
+type transportKey struct{}
+
+// transportReport records whether the last request sent with a context got
+// no response.
+type transportReport struct {
+	failed atomic.Bool
+}
+
+// withTransportReport returns a context on which the requests sent report
+// whether they got a response.
+func withTransportReport(ctx context.Context) (context.Context, *transportReport) {
+	r := &transportReport{}
+	return context.WithValue(ctx, transportKey{}, r), r
+}
+
+// wrap marks err with errNoResponse when the last request reported got no
+// response.
+func (r *transportReport) wrap(err error) error {
+	if err == nil || !r.failed.Load() {
+		return err
+	}
+	return fmt.Errorf("%w: %w", errNoResponse, err)
+}
+
+// reportingTransport reports on the context of every request whether it got
+// a response.
+type reportingTransport struct {
+	base http.RoundTripper
+}
+
+func (t reportingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if r, ok := req.Context().Value(transportKey{}).(*transportReport); ok {
+		r.failed.Store(err != nil)
+	}
+	return resp, err
+}
+
+// breaker stops requests to Keycloak once threshold requests in a row found
+// it unavailable. After cooldown requests are let through again; the first
+// failure reopens it and the first success closes it.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *breaker) allow(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.threshold && now.Before(b.openUntil) {
+		return fmt.Errorf("%w: not retrying before %s", ErrUnavailable, b.openUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (b *breaker) record(now time.Time, unavailable bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !unavailable {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
@@ -0,0 +1,325 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+	"github.com/samber/lo"
+)
+
+// RoleMembersOptions tunes how GetRoleMembers resolves roles.
+type RoleMembersOptions struct {
+	// ClientID is the clientId of the client whose roles are looked up.
+	// Realm roles are looked up when it is empty.
+	ClientID string
+	// ExpandComposites also returns the users holding a composite role that
+	// includes the requested one, directly or through other composites.
+	// Composite realm roles and composite roles of ClientID are considered.
+	ExpandComposites bool
+	// IncludeGroupMembers also returns the members of the groups holding
+	// the role, and of their subgroups, which inherit it.
+	IncludeGroupMembers bool
+	// IncludeFederatedIdentities fills in User.FederatedIdentities, which
+	// costs one extra request per user.
+	IncludeFederatedIdentities bool
+}
+
+// GetRoleMembers returns the users holding the named roles in realm. An empty
+// realm queries the realm the client logs in to.
+func (k *KeycloakClient) GetRoleMembers(ctx context.Context, realm string, roleNames []string, opts RoleMembersOptions) (*GroupMembersResult, error) {
+	if realm == "" {
+		realm = k.Realm
+	}
+	ctx, stale := withStaleReport(ctx)
+
+	var clientUUID string
+	if opts.ClientID != "" {
+		c, err := k.client(ctx, realm, opts.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			return nil, fmt.Errorf("client %s not exists in realm %s", opts.ClientID, realm)
+		}
+		clientUUID = gocloak.PString(c.ID)
+	}
+
+	// Index the composite roles once, rather than once per role, so the
+	// lookups below send at most k.parallelism requests at a time.
+	var (
+		parents           map[string][]*gocloak.Role
+		compositeWarnings []string
+	)
+	if opts.ExpandComposites {
+		var err error
+		if parents, compositeWarnings, err = k.compositeIndex(ctx, realm, clientUUID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Resolve the roles, and the composites granting them when asked for.
+	resolved := make([][]*gocloak.Role, len(roleNames))
+	err := k.forEach(ctx, len(roleNames), func(ctx context.Context, i int) error {
+		role, err := k.role(ctx, realm, clientUUID, roleNames[i])
+		if err != nil {
+			return err
+		}
+		if role == nil {
+			return fmt.Errorf("role %s not exists in realm %s", roleNames[i], realm)
+		}
+
+		resolved[i] = append([]*gocloak.Role{role}, compositeParents(parents, role)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	roles := lo.UniqBy(lo.Flatten(resolved), func(r *gocloak.Role) string { return gocloak.PString(r.ID) })
+
+	users := make([]listing[User], len(roles))
+	groups := make([]listing[*gocloak.Group], len(roles))
+	err = k.forEach(ctx, len(roles), func(ctx context.Context, i int) error {
+		var err error
+		if users[i], err = k.roleUsers(ctx, realm, roles[i]); err != nil {
+			return err
+		}
+		if opts.IncludeGroupMembers {
+			groups[i], err = k.roleGroups(ctx, realm, roles[i])
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GroupMembersResult{Members: []User{}, Warnings: compositeWarnings}
+	for i, role := range roles {
+		if users[i].Truncated {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("role %s has more than %d users, only the first %d are returned", gocloak.PString(role.Name), k.maxResults, k.maxResults))
+		}
+		result.Members = append(result.Members, users[i].Items...)
+	}
+
+	if opts.IncludeGroupMembers {
+		var holders []*gocloak.Group
+		for i, role := range roles {
+			if groups[i].Truncated {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("role %s is held by more than %d groups, only the first %d are included", gocloak.PString(role.Name), k.maxResults, k.maxResults))
+			}
+			holders = append(holders, groups[i].Items...)
+		}
+		holders = lo.UniqBy(holders, func(g *gocloak.Group) string { return gocloak.PString(g.ID) })
+
+		descendants := make([][]*gocloak.Group, len(holders))
+		descendantWarnings := make([][]string, len(holders))
+		err = k.forEach(ctx, len(holders), func(ctx context.Context, i int) error {
+			var err error
+			descendants[i], descendantWarnings[i], err = k.descendants(ctx, realm, holders[i])
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.Warnings = append(result.Warnings, lo.Flatten(descendantWarnings)...)
+
+		groups := make([]*gocloak.Group, 0, len(holders))
+		for i, g := range holders {
+			groups = append(groups, g)
+			groups = append(groups, descendants[i]...)
+		}
+		groups = lo.UniqBy(groups, func(g *gocloak.Group) string { return gocloak.PString(g.ID) })
+		if err := k.addGroupMembers(ctx, realm, groups, result); err != nil {
+			return nil, err
+		}
+	}
+	return k.finish(ctx, realm, result, opts.IncludeFederatedIdentities, stale)
+}
+
+// client returns the client with the supplied clientId, or nil if there is
+// none.
+func (k *KeycloakClient) client(ctx context.Context, realm, clientID string) (*gocloak.Client, error) {
+	key := k.cacheKey(realm, "client", clientID)
+	return load(ctx, k, k.cacheClient, key, defaultCacheExpiration, func(ctx context.Context) (*gocloak.Client, error) {
+		var clients []*gocloak.Client
+		err := k.call(ctx, func(ctx context.Context, token string) (err error) {
+			clients, err = k.keycloakClient.GetClients(ctx, token, realm, gocloak.GetClientsParams{ClientID: gocloak.StringP(clientID)})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		c, _ := lo.Find(clients, func(c *gocloak.Client) bool { return gocloak.PString(c.ClientID) == clientID })
+		return c, nil
+	})
+}
+
+// role returns a realm role, or a role of the client with the supplied ID
+// when it is set. A missing role resolves to nil.
+func (k *KeycloakClient) role(ctx context.Context, realm, clientUUID, name string) (*gocloak.Role, error) {
+	key := k.cacheKey(realm, "role", clientUUID, name)
+	return load(ctx, k, k.cacheRole, key, defaultCacheExpiration, func(ctx context.Context) (*gocloak.Role, error) {
+		var role *gocloak.Role
+		err := k.call(ctx, func(ctx context.Context, token string) (err error) {
+			if clientUUID != "" {
+				role, err = k.keycloakClient.GetClientRole(ctx, token, realm, clientUUID, name)
+			} else {
+				role, err = k.keycloakClient.GetRealmRole(ctx, token, realm, name)
+			}
+			return err
+		})
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return role, err
+	})
+}
+
+// compositeIndex maps the ID of every role included in a composite role to
+// the composites including it directly, along with warnings for role listings
+// cut off by the result cap.
+func (k *KeycloakClient) compositeIndex(ctx context.Context, realm, clientUUID string) (map[string][]*gocloak.Role, []string, error) {
+	candidates, warnings, err := k.compositeRoles(ctx, realm, clientUUID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	children := make([]listing[*gocloak.Role], len(candidates))
+	err = k.forEach(ctx, len(candidates), func(ctx context.Context, i int) error {
+		var err error
+		children[i], err = k.composites(ctx, realm, candidates[i])
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	parents := map[string][]*gocloak.Role{}
+	for i, c := range candidates {
+		for _, child := range children[i].Items {
+			parents[gocloak.PString(child.ID)] = append(parents[gocloak.PString(child.ID)], c)
+		}
+	}
+	return parents, warnings, nil
+}
+
+// compositeParents returns the composite roles of the index that include
+// role, directly or through other composites.
+func compositeParents(parents map[string][]*gocloak.Role, role *gocloak.Role) []*gocloak.Role {
+	result := []*gocloak.Role{}
+	visited := map[string]bool{gocloak.PString(role.ID): true}
+	queue := []*gocloak.Role{role}
+	for len(queue) > 0 {
+		for _, p := range parents[gocloak.PString(queue[0].ID)] {
+			if visited[gocloak.PString(p.ID)] {
+				continue
+			}
+			visited[gocloak.PString(p.ID)] = true
+			result = append(result, p)
+			queue = append(queue, p)
+		}
+		queue = queue[1:]
+	}
+	return result
+}
+
+// compositeRoles returns the composite realm roles, and the composite roles of
+// the client with the supplied ID when it is set.
+func (k *KeycloakClient) compositeRoles(ctx context.Context, realm, clientUUID string) ([]*gocloak.Role, []string, error) {
+	containers := []string{""}
+	if clientUUID != "" {
+		containers = append(containers, clientUUID)
+	}
+
+	var (
+		result   []*gocloak.Role
+		warnings []string
+	)
+	for _, container := range containers {
+		key := k.cacheKey(realm, "roles", container)
+		roles, err := load(ctx, k, k.cacheRoles, key, defaultCacheExpiration, func(ctx context.Context) (listing[*gocloak.Role], error) {
+			return listAll(k.pageSize, k.maxResults, func(first, max int) (page []*gocloak.Role, err error) {
+				params := gocloak.GetRoleParams{First: gocloak.IntP(first), Max: gocloak.IntP(max), BriefRepresentation: gocloak.BoolP(false)}
+				err = k.call(ctx, func(ctx context.Context, token string) error {
+					if container != "" {
+						page, err = k.keycloakClient.GetClientRoles(ctx, token, realm, container, params)
+					} else {
+						page, err = k.keycloakClient.GetRealmRoles(ctx, token, realm, params)
+					}
+					return err
+				})
+				return page, err
+			})
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if roles.Truncated {
+			warnings = append(warnings, fmt.Sprintf("more than %d roles found, composites among the rest are not expanded", k.maxResults))
+		}
+		result = append(result, lo.Filter(roles.Items, func(r *gocloak.Role, _ int) bool { return gocloak.PBool(r.Composite) })...)
+	}
+	return result, warnings, nil
+}
+
+// composites returns the roles a composite role includes.
+func (k *KeycloakClient) composites(ctx context.Context, realm string, role *gocloak.Role) (listing[*gocloak.Role], error) {
+	key := k.cacheKey(realm, "composites", gocloak.PString(role.ID))
+	return load(ctx, k, k.cacheRoles, key, defaultCacheExpiration, func(ctx context.Context) (listing[*gocloak.Role], error) {
+		var roles []*gocloak.Role
+		err := k.call(ctx, func(ctx context.Context, token string) (err error) {
+			roles, err = k.keycloakClient.GetCompositeRolesByRoleID(ctx, token, realm, gocloak.PString(role.ID))
+			return err
+		})
+		return listing[*gocloak.Role]{Items: roles}, err
+	})
+}
+
+// roleUsers returns the users a role is mapped to directly.
+func (k *KeycloakClient) roleUsers(ctx context.Context, realm string, role *gocloak.Role) (listing[User], error) {
+	key := k.cacheKey(realm, "role-users", gocloak.PString(role.ID))
+	return load(ctx, k, k.cacheRoleUsers, key, defaultCacheExpiration, func(ctx context.Context) (listing[User], error) {
+		users, err := listAll(k.pageSize, k.maxResults, func(first, max int) (page []*gocloak.User, err error) {
+			params := gocloak.GetUsersByRoleParams{First: gocloak.IntP(first), Max: gocloak.IntP(max)}
+			err = k.call(ctx, func(ctx context.Context, token string) error {
+				if gocloak.PBool(role.ClientRole) {
+					page, err = k.keycloakClient.GetUsersByClientRoleName(ctx, token, realm, gocloak.PString(role.ContainerID), gocloak.PString(role.Name), params)
+				} else {
+					page, err = k.keycloakClient.GetUsersByRoleName(ctx, token, realm, gocloak.PString(role.Name), params)
+				}
+				return err
+			})
+			return page, err
+		})
+		if err != nil {
+			return listing[User]{}, err
+		}
+		return listing[User]{
+			Items:     lo.Map(users.Items, func(item *gocloak.User, _ int) User { return newUser(item) }),
+			Truncated: users.Truncated,
+		}, nil
+	})
+}
+
+// roleGroups returns the groups a role is mapped to directly.
+func (k *KeycloakClient) roleGroups(ctx context.Context, realm string, role *gocloak.Role) (listing[*gocloak.Group], error) {
+	path := []string{"roles", gocloak.PString(role.Name), "groups"}
+	if gocloak.PBool(role.ClientRole) {
+		path = append([]string{"clients", gocloak.PString(role.ContainerID)}, path...)
+	}
+
+	key := k.cacheKey(realm, "role-groups", gocloak.PString(role.ID))
+	return load(ctx, k, k.cacheRoleGroups, key, defaultCacheExpiration, func(ctx context.Context) (listing[*gocloak.Group], error) {
+		return listAll(k.pageSize, k.maxResults, func(first, max int) (page []*gocloak.Group, err error) {
+			err = k.call(ctx, func(ctx context.Context, token string) error {
+				page = nil
+				resp, err := k.keycloakClient.GetRequestWithBearerAuth(ctx, token).
+					SetResult(&page).
+					SetQueryParams(map[string]string{"first": strconv.Itoa(first), "max": strconv.Itoa(max), "briefRepresentation": "false"}).
+					Get(k.adminURL(realm, path...))
+				return checkResponse(resp, err, "could not get role groups")
+			})
+			return page, err
+		})
+	})
+}
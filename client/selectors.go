@@ -0,0 +1,222 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+	"github.com/samber/lo"
+)
+
+// GroupSelector picks groups by pattern or attribute. A group must match every
+// field set.
+type GroupSelector struct {
+	// Glob matches group names using path.Match syntax, such as
+	// "team-*-admins". Patterns starting with "/" match full group paths.
+	Glob string
+	// Regex matches group names, or full group paths when it starts with
+	// "^/".
+	Regex string
+	// Attributes maps group attributes to the value a group must hold.
+	Attributes map[string]string
+}
+
+func (s GroupSelector) String() string {
+	var parts []string
+	if s.Glob != "" {
+		parts = append(parts, fmt.Sprintf("glob %q", s.Glob))
+	}
+	if s.Regex != "" {
+		parts = append(parts, fmt.Sprintf("regex %q", s.Regex))
+	}
+	for _, k := range slices.Sorted(maps.Keys(s.Attributes)) {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, s.Attributes[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// selectGroups returns the groups matching a selector. Keycloak's group search
+// narrows the groups down, by attribute query or by the longest literal text
+// of the pattern, so the realm's groups are never listed in full.
+func (k *KeycloakClient) selectGroups(ctx context.Context, realm string, s GroupSelector) (listing[*gocloak.Group], error) {
+	match, search, err := s.matcher()
+	if err != nil {
+		return listing[*gocloak.Group]{}, err
+	}
+	if search == "" && len(s.Attributes) == 0 {
+		return listing[*gocloak.Group]{}, fmt.Errorf("group selector %s has no literal text to search for", s)
+	}
+
+	params := gocloak.GetGroupsParams{BriefRepresentation: gocloak.BoolP(false)}
+	if len(s.Attributes) > 0 {
+		params.Q = gocloak.StringP(attributeQuery(s.Attributes))
+	} else {
+		params.Search = gocloak.StringP(search)
+	}
+
+	key := k.cacheKey(realm, "group-search", gocloak.PString(params.Search), gocloak.PString(params.Q))
+	found, err := load(ctx, k, k.cacheGroups, key, defaultCacheExpiration, func(ctx context.Context) (listing[*gocloak.Group], error) {
+		return listAll(k.pageSize, k.maxResults, func(first, max int) (page []*gocloak.Group, err error) {
+			params := params
+			params.First, params.Max = gocloak.IntP(first), gocloak.IntP(max)
+			err = k.call(ctx, func(ctx context.Context, token string) error {
+				page, err = k.keycloakClient.GetGroups(ctx, token, realm, params)
+				return err
+			})
+			return page, err
+		})
+	})
+	if err != nil {
+		return listing[*gocloak.Group]{}, err
+	}
+
+	// Search results come back as trees holding the matches along with their
+	// ancestors, so every group in them is checked. The subgroups inlined are
+	// only those leading to a match, so they are dropped from the groups
+	// returned to have descendants read all of them.
+	result := listing[*gocloak.Group]{Items: []*gocloak.Group{}, Truncated: found.Truncated}
+	var walk func(groups []*gocloak.Group)
+	walk = func(groups []*gocloak.Group) {
+		for _, g := range groups {
+			if match(g) {
+				selected := *g
+				selected.SubGroups = nil
+				result.Items = append(result.Items, &selected)
+			}
+			if g.SubGroups != nil {
+				walk(lo.Map(*g.SubGroups, func(sub gocloak.Group, _ int) *gocloak.Group { return &sub }))
+			}
+		}
+	}
+	walk(found.Items)
+	result.Items = lo.UniqBy(result.Items, func(g *gocloak.Group) string { return gocloak.PString(g.ID) })
+	return result, nil
+}
+
+// matcher returns a func reporting whether a group matches the selector, along
+// with the text to search Keycloak for.
+func (s GroupSelector) matcher() (func(*gocloak.Group) bool, string, error) {
+	var (
+		re     *regexp.Regexp
+		search string
+	)
+	if s.Regex != "" {
+		var err error
+		if re, err = regexp.Compile(s.Regex); err != nil {
+			return nil, "", fmt.Errorf("invalid group selector regex %q: %w", s.Regex, err)
+		}
+		search = regexLiteral(s.Regex)
+	}
+	if s.Glob != "" {
+		if _, err := path.Match(s.Glob, ""); err != nil {
+			return nil, "", fmt.Errorf("invalid group selector glob %q: %w", s.Glob, err)
+		}
+		if lit := globLiteral(s.Glob); len(lit) > len(search) {
+			search = lit
+		}
+	}
+
+	match := func(g *gocloak.Group) bool {
+		if s.Glob != "" {
+			subject := gocloak.PString(g.Name)
+			if strings.HasPrefix(s.Glob, "/") {
+				subject = gocloak.PString(g.Path)
+			}
+			if ok, _ := path.Match(s.Glob, subject); !ok {
+				return false
+			}
+		}
+		if re != nil {
+			subject := gocloak.PString(g.Name)
+			if strings.HasPrefix(s.Regex, "^/") {
+				subject = gocloak.PString(g.Path)
+			}
+			if !re.MatchString(subject) {
+				return false
+			}
+		}
+		for k, v := range s.Attributes {
+			if g.Attributes == nil || !slices.Contains((*g.Attributes)[k], v) {
+				return false
+			}
+		}
+		return true
+	}
+	return match, search, nil
+}
+
+// attributeQuery builds the q parameter Keycloak searches attributes with.
+func attributeQuery(attributes map[string]string) string {
+	quote := func(s string) string {
+		if strings.ContainsAny(s, ` ":`) {
+			return `"` + s + `"`
+		}
+		return s
+	}
+	var terms []string
+	for _, k := range slices.Sorted(maps.Keys(attributes)) {
+		terms = append(terms, quote(k)+":"+quote(attributes[k]))
+	}
+	return strings.Join(terms, " ")
+}
+
+// globLiteral returns the longest text of a glob's last path segment free of
+// wildcards.
+func globLiteral(glob string) string {
+	segment := glob[strings.LastIndex(glob, "/")+1:]
+	var longest string
+	for _, lit := range strings.FieldsFunc(segment, func(r rune) bool { return strings.ContainsRune(`*?[]\`, r) }) {
+		if len(lit) > len(longest) {
+			longest = lit
+		}
+	}
+	return longest
+}
+
+// regexLiteral returns the longest text every match of the regex contains in
+// the last path segment, looking at the top-level sequence only, or "" when
+// there is none.
+func regexLiteral(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+
+	var longest, current string
+	for _, sub := range subs {
+		for sub.Op == syntax.OpCapture {
+			sub = sub.Sub[0]
+		}
+		if sub.Op != syntax.OpLiteral {
+			longest, current = longer(longest, current), ""
+			continue
+		}
+		current += string(sub.Rune)
+		// Keycloak searches group names, so text before a "/" is of no use.
+		if i := strings.LastIndex(current, "/"); i >= 0 {
+			longest, current = "", current[i+1:]
+		}
+	}
+	return longer(longest, current)
+}
+
+func longer(a, b string) string {
+	if len(b) > len(a) {
+		return b
+	}
+	return a
+}
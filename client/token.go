@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+)
+
+// tokenExpirySkew is how long before its expiry an access token is renewed,
+// so requests never go out with a token about to lapse. Short-lived tokens
+// are renewed halfway through their lifetime instead.
+const tokenExpirySkew = 30 * time.Second
+
+// token is an access token along with what is needed to renew it.
+type token struct {
+	access    string
+	expiresAt time.Time
+
+	refresh          string
+	refreshExpiresAt time.Time
+}
+
+func (k *KeycloakClient) newToken(jwt *gocloak.JWT) *token {
+	now := k.now()
+	lifetime := time.Duration(jwt.ExpiresIn) * time.Second
+	t := &token{
+		access:    jwt.AccessToken,
+		expiresAt: now.Add(lifetime - min(tokenExpirySkew, lifetime/2)),
+		refresh:   jwt.RefreshToken,
+	}
+	// Keycloak reports 0 for refresh tokens that do not expire.
+	if jwt.RefreshExpiresIn > 0 {
+		refreshLifetime := time.Duration(jwt.RefreshExpiresIn) * time.Second
+		t.refreshExpiresAt = now.Add(refreshLifetime - min(tokenExpirySkew, refreshLifetime/2))
+	}
+	return t
+}
+
+func (t *token) canRefresh(now time.Time) bool {
+	return t.refresh != "" && (t.refreshExpiresAt.IsZero() || now.Before(t.refreshExpiresAt))
+}
+
+// GetToken returns a valid access token, logging in or using the refresh
+// token when the current one is about to expire. Concurrent callers share the
+// renewal, which stops once every one of them gave up.
+func (k *KeycloakClient) GetToken(ctx context.Context) (string, error) {
+	k.tokenMu.Lock()
+	current := k.token
+	k.tokenMu.Unlock()
+	if current != nil && k.now().Before(current.expiresAt) {
+		return current.access, nil
+	}
+
+	access, err := k.shared.do(ctx, k.cacheKey(k.Realm, "token", k.ClientId), func(ctx context.Context) (any, error) {
+		ctx, report := withTransportReport(ctx)
+		t, err := k.renewToken(ctx, current)
+		if err != nil {
+			return nil, report.wrap(err)
+		}
+		k.tokenMu.Lock()
+		k.token = t
+		k.tokenMu.Unlock()
+		return t.access, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return access.(string), nil
+}
+
+// renewToken exchanges the refresh token of the current token when it is
+// still valid, and logs in with the client credentials otherwise.
+func (k *KeycloakClient) renewToken(ctx context.Context, current *token) (*token, error) {
+	if current != nil && current.canRefresh(k.now()) {
+		jwt, err := k.keycloakClient.RefreshToken(ctx, current.refresh, k.ClientId, k.ClientSecret, k.Realm)
+		if err == nil {
+			return k.newToken(jwt), nil
+		}
+	}
+
+	jwt, err := k.keycloakClient.LoginClient(ctx, k.ClientId, k.ClientSecret, k.Realm)
+	if err != nil {
+		return nil, err
+	}
+	return k.newToken(jwt), nil
+}
+
+// invalidateToken drops the access token if it is still the current one.
+func (k *KeycloakClient) invalidateToken(access string) {
+	k.tokenMu.Lock()
+	defer k.tokenMu.Unlock()
+	if k.token != nil && k.token.access == access {
+		k.token = nil
+	}
+}
+
+// call runs a Keycloak request with a valid access token, passing fn the
+// context to send it with. When Keycloak rejects the token with 401 it is
+// dropped and the request retried once with a new one. Requests are not sent
+// while the circuit breaker is open, and errors meaning Keycloak is down wrap
+// ErrUnavailable.
+func (k *KeycloakClient) call(ctx context.Context, fn func(ctx context.Context, token string) error) error {
+	if err := k.breaker.allow(k.now()); err != nil {
+		return err
+	}
+	ctx, report := withTransportReport(ctx)
+	err := report.wrap(k.callWithToken(ctx, fn))
+	unavailable := isUnavailable(ctx, err)
+	if ctx.Err() == nil {
+		k.breaker.record(k.now(), unavailable)
+	}
+	if unavailable {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+func (k *KeycloakClient) callWithToken(ctx context.Context, fn func(ctx context.Context, token string) error) error {
+	token, err := k.GetToken(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(ctx, token)
+	if !isUnauthorized(err) {
+		return err
+	}
+
+	k.invalidateToken(token)
+	token, err = k.GetToken(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(ctx, token)
+}
+
+func isUnauthorized(err error) bool {
+	var apiErr *gocloak.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized
+}
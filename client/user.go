@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	gocloak "github.com/Nerzal/gocloak/v13"
+)
+
+// User is the part of a Keycloak user the function works with.
+type User struct {
+	ID                     string
+	Username               string
+	Email                  string
+	FirstName              string
+	LastName               string
+	Enabled                bool
+	EmailVerified          bool
+	ServiceAccountClientID string
+	Attributes             map[string][]string
+
+	// FederatedIdentities maps identity provider aliases to the user name
+	// at that provider. It is only set when requested.
+	FederatedIdentities map[string]string
+
+	// Groups holds the paths of the groups the user was found through.
+	Groups []string
+}
+
+func newUser(u *gocloak.User) User {
+	user := User{
+		ID:                     gocloak.PString(u.ID),
+		Username:               gocloak.PString(u.Username),
+		Email:                  gocloak.PString(u.Email),
+		FirstName:              gocloak.PString(u.FirstName),
+		LastName:               gocloak.PString(u.LastName),
+		Enabled:                gocloak.PBool(u.Enabled),
+		EmailVerified:          gocloak.PBool(u.EmailVerified),
+		ServiceAccountClientID: gocloak.PString(u.ServiceAccountClientID),
+	}
+	if u.Attributes != nil {
+		user.Attributes = *u.Attributes
+	}
+	return user
+}
+
+// federatedIdentities returns the identity provider links of a user.
+func (k *KeycloakClient) federatedIdentities(ctx context.Context, realm, userID string) (map[string]string, error) {
+	key := k.cacheKey(realm, "federated", userID)
+	return load(ctx, k, k.cacheFederated, key, defaultCacheExpiration, func(ctx context.Context) (map[string]string, error) {
+		var identities []*gocloak.FederatedIdentityRepresentation
+		err := k.call(ctx, func(ctx context.Context, token string) (err error) {
+			identities, err = k.keycloakClient.GetUserFederatedIdentities(ctx, token, realm, userID)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		links := make(map[string]string, len(identities))
+		for _, i := range identities {
+			links[gocloak.PString(i.IdentityProvider)] = gocloak.PString(i.UserName)
+		}
+		return links, nil
+	})
+}
+
+// UsersResult is what GetUsers found.
+type UsersResult struct {
+	// Users are keyed by the user reference they were asked for. Users that
+	// do not exist are left out.
+	Users map[string]User
+	// Missing lists the references no user was found for.
+	Missing []string
+	// Warnings tell about stale values served while Keycloak is unavailable.
+	Warnings []string
+}
+
+// GetUsers returns the referenced users in realm. An empty realm queries the
+// realm the client logs in to. Users are referenced by ID, username or email.
+func (k *KeycloakClient) GetUsers(ctx context.Context, realm string, userRefs []string) (*UsersResult, error) {
+	if realm == "" {
+		realm = k.Realm
+	}
+	ctx, stale := withStaleReport(ctx)
+
+	found := make([]*gocloak.User, len(userRefs))
+	err := k.forEach(ctx, len(userRefs), func(ctx context.Context, i int) error {
+		var err error
+		found[i], err = k.resolveUser(ctx, realm, userRefs[i])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UsersResult{Users: map[string]User{}}
+	for i, ref := range userRefs {
+		if found[i] == nil {
+			result.Missing = append(result.Missing, ref)
+			continue
+		}
+		result.Users[ref] = newUser(found[i])
+	}
+	if since, ok := stale.since(); ok {
+		result.Warnings = append(result.Warnings, k.staleWarning(since))
+	}
+	return result, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"unicode"
+)
+
+// setOperators maps every accepted operator to its ASCII form.
+var setOperators = map[rune]rune{
+	'|': '|', '∪': '|',
+	'&': '&', '∩': '&',
+	'-': '-', '−': '-',
+	'^': '^', '△': '^',
+	'(': '(', ')': ')',
+}
+
+// evalSetExpression evaluates a set expression over the named user lists.
+// Users are compared by key, and results keep the order users appear in
+// their operands.
+func evalSetExpression(expr string, sets map[string][]string, key func(string) string) ([]string, error) {
+	tokens, err := tokenizeSetExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &setParser{tokens: tokens, sets: sets, key: key}
+	result, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression %q", p.tokens[p.pos], expr)
+	}
+	return result, nil
+}
+
+func tokenizeSetExpression(expr string) ([]string, error) {
+	var tokens []string
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case setOperators[r] != 0:
+			tokens = append(tokens, string(setOperators[r]))
+			i++
+		case isSetNameRune(r):
+			start := i
+			for i < len(runes) && isSetNameRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		default:
+			return nil, fmt.Errorf("unexpected %q in expression %q", r, expr)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	return tokens, nil
+}
+
+// isSetNameRune reports whether r may appear in the name of a user set. '-'
+// may not, since it is the difference operator.
+func isSetNameRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// validateSetName returns an error if name cannot be referenced from a set
+// expression.
+func validateSetName(name string) error {
+	if name == "" {
+		return fmt.Errorf("user set name must not be empty")
+	}
+	for _, r := range name {
+		if !isSetNameRune(r) {
+			return fmt.Errorf("user set name %q may only contain letters, digits and '_', got %q", name, r)
+		}
+	}
+	return nil
+}
+
+// setParser evaluates the grammar
+//
+//	expression = term { ("|" | "-" | "^") term }
+//	term       = operand { "&" operand }
+//	operand    = name | "(" expression ")"
+type setParser struct {
+	tokens []string
+	pos    int
+	sets   map[string][]string
+	key    func(string) string
+}
+
+func (p *setParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *setParser) expression() ([]string, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.next(); op == "|" || op == "-" || op == "^"; op = p.next() {
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "|":
+			left = append(slices.Clip(left), p.without(right, left)...)
+		case "-":
+			left = p.without(left, right)
+		case "^":
+			left = append(p.without(left, right), p.without(right, left)...)
+		}
+	}
+	return left, nil
+}
+
+func (p *setParser) term() ([]string, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.next() == "&" {
+		p.pos++
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		left = p.within(left, right)
+	}
+	return left, nil
+}
+
+func (p *setParser) operand() ([]string, error) {
+	tok := p.next()
+	p.pos++
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("expression ends early")
+	case "(":
+		result, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return result, nil
+	}
+	if _, ok := setOperators[[]rune(tok)[0]]; ok {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	users, ok := p.sets[tok]
+	if !ok {
+		return nil, fmt.Errorf("unknown user set %s", tok)
+	}
+	return users, nil
+}
+
+// without returns the users of a that are not in b.
+func (p *setParser) without(a, b []string) []string {
+	return p.filter(a, b, false)
+}
+
+// within returns the users of a that are also in b.
+func (p *setParser) within(a, b []string) []string {
+	return p.filter(a, b, true)
+}
+
+func (p *setParser) filter(a, b []string, keep bool) []string {
+	in := make(map[string]bool, len(b))
+	for _, u := range b {
+		in[p.key(u)] = true
+	}
+	out := []string{}
+	for _, u := range a {
+		if in[p.key(u)] == keep {
+			out = append(out, u)
+		}
+	}
+	return out
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/crossplane/function-keycloak/client"
+	"github.com/crossplane/function-keycloak/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
+	fncontext "github.com/crossplane/function-sdk-go/context"
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/request"
+	"github.com/crossplane/function-sdk-go/response"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// contextValue returns the value earlier steps left at key in the pipeline
+// context.
+func contextValue(req *fnv1.RunFunctionRequest, key string) (any, error) {
+	v, ok := request.GetContextKey(req, key)
+	if !ok {
+		return nil, errors.Errorf("context key %s not found", key)
+	}
+	return v.AsInterface(), nil
+}
+
+// contextUsers returns the user list earlier steps left at key in the
+// pipeline context.
+func contextUsers(req *fnv1.RunFunctionRequest, key string) ([]string, error) {
+	v, err := contextValue(req, key)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := v.([]any)
+	if !ok {
+		return nil, errors.Errorf("context key %s: not an array", key)
+	}
+	users := make([]string, 0, len(items))
+	for i, item := range items {
+		user, ok := item.(string)
+		if !ok {
+			return nil, errors.Errorf("context key %s[%d]: not a string", key, i)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// setContextUsers leaves users at key in the pipeline context for later
+// steps.
+func setContextUsers(rsp *fnv1.RunFunctionResponse, key string, users []any) error {
+	v, err := structpb.NewValue(users)
+	if err != nil {
+		return errors.Wrapf(err, "cannot convert users for context key %s", key)
+	}
+	response.SetContextKey(rsp, key, v)
+	return nil
+}
+
+// environmentConfig returns a copy of cfg where the settings read from the
+// EnvironmentConfig data in the pipeline context replace the current values.
+// A fieldpath the environment does not hold is an error rather than a reason
+// to quietly connect elsewhere.
+func environmentConfig(req *fnv1.RunFunctionRequest, cfg client.Config, env *v1beta1.EnvironmentConnection) (client.Config, error) {
+	v, err := contextValue(req, fncontext.KeyEnvironment)
+	if err != nil {
+		return cfg, err
+	}
+	data, ok := v.(map[string]any)
+	if !ok {
+		return cfg, errors.Errorf("context key %s: not an object", fncontext.KeyEnvironment)
+	}
+	paved := fieldpath.Pave(data)
+
+	settings := []struct {
+		name  string
+		field string
+		value *string
+	}{
+		{name: "url", field: env.UrlField, value: &cfg.Url},
+		{name: "realm", field: env.RealmField, value: &cfg.Realm},
+		{name: "clientId", field: env.ClientIDField, value: &cfg.ClientId},
+	}
+	for _, s := range settings {
+		if s.field == "" {
+			continue
+		}
+		value, err := paved.GetString(s.field)
+		if err != nil {
+			return cfg, errors.Wrapf(err, "cannot get Keycloak %s from environment field %s", s.name, s.field)
+		}
+		*s.value = value
+	}
+	return cfg, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/crossplane/function-keycloak/client"
+	"github.com/crossplane/function-keycloak/input/v1beta1"
+)
+
+// serviceAccountPrefix starts the username Keycloak gives the service account
+// user of a client.
+const serviceAccountPrefix = "service-account-"
+
+// filterUsers returns the users matching the filter, along with a description
+// of each user left out and why.
+func filterUsers(users []client.User, f *v1beta1.UserFilter) ([]client.User, []string) {
+	if f == nil {
+		return users, nil
+	}
+	kept := make([]client.User, 0, len(users))
+	var dropped []string
+	seen := map[string]bool{}
+	for _, u := range users {
+		reason := filterReason(u, f)
+		if reason == "" {
+			kept = append(kept, u)
+			continue
+		}
+		if !seen[u.ID] {
+			seen[u.ID] = true
+			dropped = append(dropped, fmt.Sprintf("%s (%s)", userLabel(u), reason))
+		}
+	}
+	return kept, dropped
+}
+
+// filterReason returns why the filter leaves out u, or an empty string when
+// it keeps it.
+func filterReason(u client.User, f *v1beta1.UserFilter) string {
+	if f.EnabledOnly && !u.Enabled {
+		return "disabled"
+	}
+	if f.EmailVerifiedOnly && !u.EmailVerified {
+		return "email not verified"
+	}
+	if f.ExcludeServiceAccounts && (u.ServiceAccountClientID != "" || strings.HasPrefix(u.Username, serviceAccountPrefix)) {
+		return "service account"
+	}
+	for _, name := range slices.Sorted(maps.Keys(f.Attributes)) {
+		if !slices.Contains(u.Attributes[name], f.Attributes[name]) {
+			return fmt.Sprintf("attribute %s is not %s", name, f.Attributes[name])
+		}
+	}
+	if len(f.AllowedEmailDomains) > 0 && !inEmailDomains(u.Email, f.AllowedEmailDomains) {
+		return "email domain not allowed"
+	}
+	if inEmailDomains(u.Email, f.DeniedEmailDomains) {
+		return "email domain denied"
+	}
+	return ""
+}
+
+// inEmailDomains reports whether email is in one of domains or their
+// subdomains. Domains are compared case-insensitively.
+func inEmailDomains(email string, domains []string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "@"))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
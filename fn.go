@@ -3,6 +3,10 @@ package main
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/crossplane/function-keycloak/client"
 	"github.com/crossplane/function-keycloak/input/v1beta1"
@@ -15,6 +19,7 @@ import (
 	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
 	"github.com/crossplane/function-sdk-go/request"
 	"github.com/crossplane/function-sdk-go/response"
+	"github.com/samber/lo"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -22,25 +27,79 @@ import (
 type Function struct {
 	fnv1.UnimplementedFunctionRunnerServiceServer
 
-	log            logging.Logger
-	keycloakClient client.KeycloakClientInterface
+	log         logging.Logger
+	connections *client.Registry
+	clients     *client.Pool
+	now         func() time.Time
 }
 
-func NewFunction(debug bool) (*Function, error) {
+func NewFunction(debug bool, connections *client.Registry, opts ...client.Option) (*Function, error) {
 	log, err := function.NewLogger(debug)
 	if err != nil {
 		return nil, err
 	}
-	keyCloakClient := client.NewKeycloakClient()
 	f := &Function{
-		log:            log,
-		keycloakClient: keyCloakClient,
+		log:         log,
+		now:         time.Now,
+		connections: connections,
+		clients: client.NewPool(func(cfg client.Config) client.KeycloakClientInterface {
+			return client.NewKeycloakClient(cfg, opts...)
+		}),
 	}
 	return f, nil
 }
 
+// keycloakClient returns the client for the step's connection, with any
+// settings present in the step credentials, then in the EnvironmentConfig,
+// taking precedence.
+func (f *Function) keycloakClient(req *fnv1.RunFunctionRequest, in *v1beta1.Input) (client.KeycloakClientInterface, error) {
+	cfg, ok := f.connections.Get(in.Connection)
+	if !ok {
+		return nil, errors.Errorf("unknown Keycloak connection %s", in.Connection)
+	}
+
+	name := in.CredentialsName
+	if name == "" {
+		name = v1beta1.DefaultCredentialsName
+	}
+	if _, ok := req.GetCredentials()[name]; ok {
+		creds, err := request.GetCredentials(req, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get credentials %s", name)
+		}
+		cfg = cfg.WithCredentials(creds.Data)
+	} else {
+		f.log.Debug("Credentials not found, using connection settings", "credentials", name, "connection", in.Connection)
+	}
+
+	if in.Environment != nil {
+		var err error
+		if cfg, err = environmentConfig(req, cfg, in.Environment); err != nil {
+			return nil, err
+		}
+	}
+
+	return f.clients.Get(cfg), nil
+}
+
+// lookupRealm returns the realm a step looks users up in. An empty result means the
+// realm the connection logs in to.
+func lookupRealm(xr *fieldpath.Paved, in *v1beta1.Input) (string, error) {
+	if in.RealmFromCompositeField == "" {
+		return in.Realm, nil
+	}
+	r, err := xr.GetString(in.RealmFromCompositeField)
+	if fieldpath.IsNotFound(err) {
+		return in.Realm, nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get realm from composite field %s", in.RealmFromCompositeField)
+	}
+	return r, nil
+}
+
 // RunFunction runs the Function.
-func (f *Function) RunFunction(_ context.Context, req *fnv1.RunFunctionRequest) (*fnv1.RunFunctionResponse, error) {
+func (f *Function) RunFunction(ctx context.Context, req *fnv1.RunFunctionRequest) (*fnv1.RunFunctionResponse, error) {
 	f.log.Info("Running function", "tag", req.GetMeta().GetTag())
 
 	rsp := response.To(req, response.DefaultTTL)
@@ -53,11 +112,32 @@ func (f *Function) RunFunction(_ context.Context, req *fnv1.RunFunctionRequest)
 		return rsp, nil
 	}
 
+	if in.Timeout != nil {
+		if in.Timeout.Duration <= 0 {
+			response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Invalid timeout")
+			response.Fatal(rsp, errors.Errorf("timeout must be positive, got %s", in.Timeout.Duration))
+			return rsp, nil
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, in.Timeout.Duration)
+		defer cancel()
+	}
+
 	switch in.FunctionType {
 	case v1beta1.FunctionTypeFetchUser:
-		return f.FetchUser(req, rsp, in)
+		return f.FetchUser(ctx, req, rsp, in)
 	case v1beta1.FunctionTypeDedupeUsers:
 		return f.DedupeUser(req, rsp, in)
+	case v1beta1.FunctionTypeCombineUsers:
+		return f.CombineUsers(req, rsp, in)
+	case v1beta1.FunctionTypeFetchRealmRoleUsers, v1beta1.FunctionTypeFetchClientRoleUsers:
+		return f.FetchRoleUsers(ctx, req, rsp, in)
+	case v1beta1.FunctionTypeFetchOrganizationUsers:
+		return f.FetchOrganizationUsers(ctx, req, rsp, in)
+	case v1beta1.FunctionTypeFetchUserMemberships:
+		return f.FetchUserMemberships(ctx, req, rsp, in)
+	case v1beta1.FunctionTypeValidateUsers:
+		return f.ValidateUsers(ctx, req, rsp, in)
 	default:
 		return rsp, nil
 	}
@@ -77,7 +157,359 @@ func patchFieldValueToObject(fieldPath string, value any, to runtime.Object, mo
 }
 
 // FetchUser fetches the user from the group list
-func (f *Function) FetchUser(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) (*fnv1.RunFunctionResponse, error) {
+func (f *Function) FetchUser(ctx context.Context, req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) (*fnv1.RunFunctionResponse, error) {
+	selectors := lo.Map(in.GroupList.Selectors, func(s v1beta1.GroupSelector, _ int) client.GroupSelector {
+		return client.GroupSelector{Glob: s.Glob, Regex: s.Regex, Attributes: s.Attributes}
+	})
+	policy, err := parseMissingGroupPolicy(in.GroupList.MissingGroupPolicy)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Invalid missing group policy")
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+	templates, err := parseGroupTemplates(in.GroupList.Templates)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Invalid group template")
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+	// Groups listed in the Input or picked by selectors make the group list
+	// at FromCompositeField optional.
+	otherGroups := len(in.GroupList.Groups) + len(templates) + len(in.GroupList.Sources) + len(selectors)
+	src := memberSource{
+		kind:               "group",
+		fromCompositeField: in.GroupList.FromCompositeField,
+		namesOptional:      otherGroups > 0,
+		moreNames: func(xr *fieldpath.Paved) ([]string, error) {
+			return groupNames(req, xr, in.GroupList, templates)
+		},
+		identity: in.GroupList.Identity,
+		filter:   in.GroupList.Filter,
+	}
+	return f.fetchMembers(ctx, req, rsp, in, src,
+		func(ctx context.Context, kc client.KeycloakClientInterface, realm string, names []string) (*client.GroupMembersResult, map[string]any, error) {
+			members, err := kc.GetGroupMembers(ctx, realm, names, client.GroupMembersOptions{
+				IncludeSubgroupMembers:     in.GroupList.IncludeSubgroupMembers,
+				IncludeFederatedIdentities: wantsFederatedIdentities(in.GroupList.Identity),
+				Selectors:                  selectors,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := missingGroups(members, realm, policy); err != nil {
+				return nil, nil, err
+			}
+			return members, nil, nil
+		})
+}
+
+// parseMissingGroupPolicy returns the policy regardless of its case, so the
+// spellings Crossplane lets through without validating the input mean the
+// same. An empty policy is Fail.
+func parseMissingGroupPolicy(p v1beta1.MissingGroupPolicy) (v1beta1.MissingGroupPolicy, error) {
+	if p == "" {
+		return v1beta1.MissingGroupPolicyFail, nil
+	}
+	for _, known := range []v1beta1.MissingGroupPolicy{v1beta1.MissingGroupPolicyFail, v1beta1.MissingGroupPolicyWarn, v1beta1.MissingGroupPolicyIgnore} {
+		if strings.EqualFold(string(p), string(known)) {
+			return known, nil
+		}
+	}
+	return "", errors.Errorf("unknown missingGroupPolicy %q, want Fail, Warn or Ignore", p)
+}
+
+// missingGroups applies a policy returned by parseMissingGroupPolicy to the
+// groups of the result that do not exist, failing the lookup or warning about
+// them. Selectors matching no group are warned about unless the policy is
+// Ignore.
+func missingGroups(members *client.GroupMembersResult, realm string, policy v1beta1.MissingGroupPolicy) error {
+	if policy != v1beta1.MissingGroupPolicyIgnore {
+		for _, s := range members.Unmatched {
+			members.Warnings = append(members.Warnings, fmt.Sprintf("group selector %s matches no group in realm %s", s, realm))
+		}
+	}
+	for _, g := range members.Groups {
+		if !g.Missing {
+			continue
+		}
+		switch policy {
+		case v1beta1.MissingGroupPolicyIgnore:
+		case v1beta1.MissingGroupPolicyWarn:
+			members.Warnings = append(members.Warnings, fmt.Sprintf("group %s not exists in realm %s, leaving it out", g.Ref, realm))
+		case v1beta1.MissingGroupPolicyFail:
+			return errors.Errorf("group %s not exists in realm %s", g.Ref, realm)
+		}
+	}
+	return nil
+}
+
+// FetchRoleUsers fetches the users holding the realm or client roles of the
+// role list
+func (f *Function) FetchRoleUsers(ctx context.Context, req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) (*fnv1.RunFunctionResponse, error) {
+	opts := client.RoleMembersOptions{
+		ExpandComposites:           in.RoleList.ExpandComposites,
+		IncludeGroupMembers:        in.RoleList.IncludeGroupMembers,
+		IncludeFederatedIdentities: wantsFederatedIdentities(in.RoleList.Identity),
+	}
+	if in.FunctionType == v1beta1.FunctionTypeFetchClientRoleUsers {
+		if in.RoleList.ClientID == "" {
+			response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("No client found")
+			response.Fatal(rsp, errors.Errorf("roleList.clientId is required by %s", in.FunctionType))
+			return rsp, nil
+		}
+		opts.ClientID = in.RoleList.ClientID
+	}
+	return f.fetchMembers(ctx, req, rsp, in, memberSource{kind: "role", fromCompositeField: in.RoleList.FromCompositeField, identity: in.RoleList.Identity},
+		func(ctx context.Context, kc client.KeycloakClientInterface, realm string, names []string) (*client.GroupMembersResult, map[string]any, error) {
+			members, err := kc.GetRoleMembers(ctx, realm, names, opts)
+			return members, nil, err
+		})
+}
+
+// FetchOrganizationUsers fetches the members of the organizations of the
+// organization list, along with their domains
+func (f *Function) FetchOrganizationUsers(ctx context.Context, req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) (*fnv1.RunFunctionResponse, error) {
+	opts := client.OrganizationMembersOptions{
+		IncludeFederatedIdentities: wantsFederatedIdentities(in.OrganizationList.Identity),
+	}
+	switch in.OrganizationList.MembershipType {
+	case v1beta1.MembershipTypeManaged:
+		opts.MembershipType = client.MembershipManaged
+	case v1beta1.MembershipTypeUnmanaged:
+		opts.MembershipType = client.MembershipUnmanaged
+	}
+	return f.fetchMembers(ctx, req, rsp, in, memberSource{kind: "organization", fromCompositeField: in.OrganizationList.FromCompositeField, identity: in.OrganizationList.Identity},
+		func(ctx context.Context, kc client.KeycloakClientInterface, realm string, names []string) (*client.GroupMembersResult, map[string]any, error) {
+			members, err := kc.GetOrganizationMembers(ctx, realm, names, opts)
+			if err != nil {
+				return nil, nil, err
+			}
+			var fields map[string]any
+			if in.OrganizationList.DomainsField != "" {
+				fields = map[string]any{in.OrganizationList.DomainsField: toAnySlice(members.Domains)}
+			}
+			return &members.GroupMembersResult, fields, nil
+		})
+}
+
+// FetchUserMemberships fetches the groups and effective roles of the users of
+// the user list and patches them to the desired resource, keyed by user
+func (f *Function) FetchUserMemberships(ctx context.Context, req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) (*fnv1.RunFunctionResponse, error) {
+	oxr, err := request.GetObservedCompositeResource(req)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot get observed composite resource"))
+		return rsp, nil
+	}
+	pavedXR, err := fieldpath.PaveObject(oxr.Resource)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to pave object")
+		response.Fatal(rsp, errors.Wrapf(err, "cannot pave object %s", oxr.Resource))
+		return rsp, nil
+	}
+
+	users, err := pavedXR.GetStringArray(in.UserList.FromCompositeField)
+	if err != nil {
+		response.Normalf(rsp, "cannot get user list from composite field %s as error %s", in.UserList.FromCompositeField, err.Error())
+		return rsp, nil
+	}
+
+	realm, err := lookupRealm(pavedXR, in)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get realm")
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	keycloakClient, err := f.keycloakClient(req, in)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get Keycloak client")
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	result, err := keycloakClient.GetUserMemberships(ctx, realm, users, client.UserMembershipsOptions{ClientIDs: in.UserList.ClientIDs})
+	if err != nil {
+		lookupFailed(ctx, rsp, err, fmt.Sprintf("cannot get memberships of users %s", users), "Failed to get user memberships")
+		return rsp, nil
+	}
+	for _, w := range result.Warnings {
+		response.Warning(rsp, errors.New(w)).TargetComposite()
+	}
+	for _, u := range result.Missing {
+		response.Warning(rsp, errors.Errorf("user %s not found, leaving it out of %s", u, in.OutputField)).TargetComposite()
+	}
+
+	output := make(map[string]any, len(result.Memberships))
+	for ref, m := range result.Memberships {
+		output[ref] = membershipObject(m, in.UserList.ClientIDs)
+	}
+
+	dxr, err := request.GetDesiredCompositeResource(req)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get DXR")
+		response.Fatal(rsp, errors.Wrapf(err, "Failed to get DXR"))
+		return rsp, nil
+	}
+	// See DedupeUser for why the GVK is copied from the observed XR.
+	dxr.Resource.SetAPIVersion(oxr.Resource.GetAPIVersion())
+	dxr.Resource.SetKind(oxr.Resource.GetKind())
+
+	if err = patchFieldValueToObject(in.OutputField, output, dxr.Resource, nil); err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to patch user memberships to composite")
+		response.Fatal(rsp, errors.Wrapf(err, "failed to patch user memberships to DXR"))
+		return rsp, nil
+	}
+
+	if err = response.SetDesiredCompositeResource(rsp, dxr); err != nil {
+		response.Fatal(rsp, errors.Wrapf(err, "cannot set desired composite resource in %T", rsp))
+		return rsp, nil
+	}
+
+	response.ConditionTrue(rsp, "FunctionSuccess", "Success").
+		TargetCompositeAndClaim()
+
+	return rsp, nil
+}
+
+// ValidateUsers checks the users of the user list exist in Keycloak and are
+// enabled, and either flags the unknown ones on the composite or filters them
+// out
+func (f *Function) ValidateUsers(ctx context.Context, req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) (*fnv1.RunFunctionResponse, error) {
+	mode := v1beta1.ValidationModeCondition
+	if in.Validation != nil && in.Validation.Mode != "" {
+		mode = in.Validation.Mode
+	}
+	if mode == v1beta1.ValidationModeFilter && in.OutputField == "" {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("No output field found")
+		response.Fatal(rsp, errors.New("outputField is required to filter users"))
+		return rsp, nil
+	}
+
+	oxr, err := request.GetObservedCompositeResource(req)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot get observed composite resource"))
+		return rsp, nil
+	}
+	pavedXR, err := fieldpath.PaveObject(oxr.Resource)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to pave object")
+		response.Fatal(rsp, errors.Wrapf(err, "cannot pave object %s", oxr.Resource))
+		return rsp, nil
+	}
+
+	users, err := pavedXR.GetStringArray(in.UserList.FromCompositeField)
+	if err != nil {
+		response.Normalf(rsp, "cannot get user list from composite field %s as error %s", in.UserList.FromCompositeField, err.Error())
+		return rsp, nil
+	}
+
+	realm, err := lookupRealm(pavedXR, in)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get realm")
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	keycloakClient, err := f.keycloakClient(req, in)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get Keycloak client")
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	found, err := keycloakClient.GetUsers(ctx, realm, users)
+	if err != nil {
+		lookupFailed(ctx, rsp, err, fmt.Sprintf("cannot get users %s", users), "Failed to get users")
+		return rsp, nil
+	}
+	for _, w := range found.Warnings {
+		response.Warning(rsp, errors.New(w)).TargetComposite()
+	}
+	known, unknown := partitionUsers(users, found)
+
+	dxr, err := request.GetDesiredCompositeResource(req)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get DXR")
+		response.Fatal(rsp, errors.Wrapf(err, "Failed to get DXR"))
+		return rsp, nil
+	}
+	// See DedupeUser for why the GVK is copied from the observed XR.
+	dxr.Resource.SetAPIVersion(oxr.Resource.GetAPIVersion())
+	dxr.Resource.SetKind(oxr.Resource.GetKind())
+
+	switch mode {
+	case v1beta1.ValidationModeFilter:
+		if len(unknown) > 0 {
+			response.Warning(rsp, errors.Errorf("Leaving %d unknown users of %s out of %s: %s", len(unknown), in.UserList.FromCompositeField, in.OutputField, strings.Join(unknown, ", "))).TargetComposite()
+		}
+		if err = patchFieldValueToObject(in.OutputField, toAnySlice(known), dxr.Resource, nil); err != nil {
+			response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get patch user to composite")
+			response.Fatal(rsp, errors.Wrapf(err, "failed to patch user to DXR"))
+			return rsp, nil
+		}
+	default:
+		if len(unknown) > 0 {
+			response.ConditionFalse(rsp, "UsersValid", "UnknownUsers").TargetComposite().
+				WithMessage(fmt.Sprintf("Unknown users in %s: %s", in.UserList.FromCompositeField, strings.Join(unknown, ", ")))
+		} else {
+			response.ConditionTrue(rsp, "UsersValid", "AllUsersKnown").TargetComposite()
+		}
+	}
+
+	if err = response.SetDesiredCompositeResource(rsp, dxr); err != nil {
+		response.Fatal(rsp, errors.Wrapf(err, "cannot set desired composite resource in %T", rsp))
+		return rsp, nil
+	}
+
+	response.ConditionTrue(rsp, "FunctionSuccess", "Success").
+		TargetCompositeAndClaim()
+
+	return rsp, nil
+}
+
+// lookupFailed sets the condition and fatal result for a failed Keycloak
+// lookup of what. message is the condition message of any failure other than
+// a timeout or Keycloak being unavailable.
+func lookupFailed(ctx context.Context, rsp *fnv1.RunFunctionResponse, err error, what, message string) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		// gocloak flattens the errors it returns, so the context tells us
+		// whether the call gave up because of the deadline.
+		response.ConditionFalse(rsp, "FunctionSuccess", "Timeout").TargetComposite().WithMessage("Timed out waiting for Keycloak")
+		response.Fatal(rsp, errors.Wrap(ctx.Err(), what))
+	case errors.Is(err, client.ErrUnavailable):
+		response.ConditionFalse(rsp, "FunctionSuccess", "KeycloakUnavailable").TargetComposite().WithMessage("Keycloak is unavailable, retrying on the next reconcile")
+		response.Fatal(rsp, errors.Wrap(err, what))
+	default:
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage(message)
+		response.Fatal(rsp, errors.Wrap(err, what))
+	}
+}
+
+// lookupMembers asks Keycloak for the users of the named groups, roles or
+// organizations. It also returns any other fields to write to the XR, keyed
+// by fieldpath.
+type lookupMembers func(ctx context.Context, kc client.KeycloakClientInterface, realm string, names []string) (*client.GroupMembersResult, map[string]any, error)
+
+// memberSource describes where fetchMembers reads the groups, roles or
+// organizations from and what it writes for their users.
+type memberSource struct {
+	kind               string
+	fromCompositeField string
+	// namesOptional lets fromCompositeField be unset, for lookups that find
+	// their groups some other way.
+	namesOptional bool
+	// moreNames returns further names to look up along with those at
+	// fromCompositeField.
+	moreNames func(xr *fieldpath.Paved) ([]string, error)
+	identity  *v1beta1.Identity
+	filter    *v1beta1.UserFilter
+}
+
+// fetchMembers looks up the users of the groups, roles or organizations
+// listed at src.fromCompositeField and patches the identity of those matching
+// src.filter to OutputField.
+func (f *Function) fetchMembers(ctx context.Context, req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input, src memberSource, lookup lookupMembers) (*fnv1.RunFunctionResponse, error) {
 	resource := req.GetObserved().GetComposite().Resource
 	convertedResource, err := runtime.DefaultUnstructuredConverter.ToUnstructured(resource)
 	if err != nil {
@@ -86,19 +518,92 @@ func (f *Function) FetchUser(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunction
 		return rsp, nil
 	}
 
-	groupList, err := fieldpath.Pave(convertedResource).GetStringArray(in.GroupList.FromCompositeField)
+	pavedXR := fieldpath.Pave(convertedResource)
+	var names []string
+	if src.fromCompositeField != "" || !src.namesOptional {
+		names, err = pavedXR.GetStringArray(src.fromCompositeField)
+		if err != nil {
+			response.Normalf(rsp, "cannot get %s list from composite field %s as error %s", src.kind, src.fromCompositeField, err.Error())
+			return rsp, nil
+		}
+	}
+	if src.moreNames != nil {
+		more, err := src.moreNames(pavedXR)
+		if err != nil {
+			response.Normalf(rsp, "cannot get %s list as error %s", src.kind, err.Error())
+			return rsp, nil
+		}
+		names = lo.Uniq(append(names, more...))
+	}
+
+	realm, err := lookupRealm(pavedXR, in)
 	if err != nil {
-		response.Normalf(rsp, "cannot get group list from composite field %s as error %s", in.GroupList.FromCompositeField, err.Error())
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get realm")
+		response.Fatal(rsp, err)
 		return rsp, nil
 	}
 
-	userList, err := f.keycloakClient.GetGroupMembers(groupList)
+	keycloakClient, err := f.keycloakClient(req, in)
 	if err != nil {
-		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get list user")
-		response.Fatal(rsp, errors.Wrapf(err, fmt.Sprintf("cannot get group user of group %s", groupList)))
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get Keycloak client")
+		response.Fatal(rsp, err)
 		return rsp, nil
 	}
 
+	members, fields, err := lookup(ctx, keycloakClient, realm, names)
+	if err != nil {
+		lookupFailed(ctx, rsp, err, fmt.Sprintf("cannot get users of %s %s", src.kind, names), "Failed to get list user")
+		return rsp, nil
+	}
+	for _, w := range members.Warnings {
+		response.Warning(rsp, errors.New(w)).TargetComposite()
+	}
+
+	users, dropped := filterUsers(members.Members, src.filter)
+	if len(dropped) > 0 {
+		response.Normalf(rsp, "Left out %d users not matching the filter%s", len(dropped), listUsers(dropped, maxListed(in.ChangeReport)))
+	}
+
+	var output []any
+	switch in.OutputFormat {
+	case v1beta1.OutputFormatObjects:
+		output = userObjects(users, in.UserObject)
+	default:
+		userList, warnings, err := identities(mergeUsers(users), src.identity)
+		if err != nil {
+			response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get user identity")
+			response.Fatal(rsp, err)
+			return rsp, nil
+		}
+		for _, w := range warnings {
+			response.Warning(rsp, errors.New(w)).TargetComposite()
+		}
+		output = toAnySlice(userList)
+	}
+	output = arrangeUsers(output, in)
+
+	// Keep what the XR holds when the users found look like the result of a
+	// broken Keycloak rather than a real change. Users only written to the
+	// pipeline Context have nothing to compare with.
+	write := true
+	toXR := in.OutputField != "" || in.OutputContextKey == ""
+	var (
+		observed []any
+		found    bool
+	)
+	if toXR {
+		observed, found = observedUsers(pavedXR, in.OutputField)
+	}
+	if violation := guardrailViolation(in.Guardrails, observed, output, in.IgnoreEmailCase); violation != "" {
+		if guardrailsOverridden(pavedXR) {
+			response.Normalf(rsp, "Guardrails overridden by annotation %s: %s", v1beta1.AnnotationOverrideGuardrails, violation)
+		} else {
+			output, write = observed, found
+			response.Warning(rsp, errors.Errorf("Keeping the observed %s: %s", in.OutputField, violation)).TargetComposite()
+			response.ConditionFalse(rsp, "MembershipUpdated", "GuardrailTripped").TargetComposite().WithMessage(violation)
+		}
+	}
+
 	dxr, err := request.GetDesiredCompositeResource(req)
 	if err != nil {
 		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get DXR")
@@ -123,11 +628,41 @@ func (f *Function) FetchUser(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunction
 	dxr.Resource.SetAPIVersion(oxr.Resource.GetAPIVersion())
 	dxr.Resource.SetKind(oxr.Resource.GetKind())
 
-	err = patchFieldValueToObject(in.OutputField, userList, dxr.Resource, nil)
-	if err != nil {
-		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get patch user to composite")
-		response.Fatal(rsp, errors.Wrapf(err, "failed to patch user to DXR"))
-		return rsp, nil
+	if write && in.OutputContextKey != "" {
+		if err := setContextUsers(rsp, in.OutputContextKey, output); err != nil {
+			response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to write users to context")
+			response.Fatal(rsp, err)
+			return rsp, nil
+		}
+	}
+
+	if write && toXR {
+		err = patchFieldValueToObject(in.OutputField, output, dxr.Resource, nil)
+		if err != nil {
+			response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get patch user to composite")
+			response.Fatal(rsp, errors.Wrapf(err, "failed to patch user to DXR"))
+			return rsp, nil
+		}
+
+		change := diffMembers(observed, output, in.IgnoreEmailCase)
+		reportChanges(rsp, in.OutputField, change, in.ChangeReport)
+		if in.ChangeReport != nil && in.ChangeReport.SummaryField != "" {
+			summaryPath := changeSummaryPath(in.ChangeReport.SummaryField, in.OutputField)
+			err = patchFieldValueToObject(summaryPath, changeSummary(pavedXR, summaryPath, change, f.now()), dxr.Resource, nil)
+			if err != nil {
+				response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to patch change summary to composite")
+				response.Fatal(rsp, errors.Wrapf(err, "failed to patch change summary to DXR"))
+				return rsp, nil
+			}
+		}
+	}
+
+	for _, path := range slices.Sorted(maps.Keys(fields)) {
+		if err = patchFieldValueToObject(path, fields[path], dxr.Resource, nil); err != nil {
+			response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to patch field to composite")
+			response.Fatal(rsp, errors.Wrapf(err, "failed to patch %s to DXR", path))
+			return rsp, nil
+		}
 	}
 
 	if err = response.SetDesiredCompositeResource(rsp, dxr); err != nil {
@@ -141,6 +676,13 @@ func (f *Function) FetchUser(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunction
 	return rsp, nil
 }
 
+// destination is where DedupeUser writes the users of a priority: an XR path,
+// a pipeline Context key, or both.
+type destination struct {
+	path       string
+	contextKey string
+}
+
 // DedupeUser dedupes the user from the group list and patch them to the desired resource
 func (f *Function) DedupeUser(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) (*fnv1.RunFunctionResponse, error) {
 	dxr, err := request.GetDesiredCompositeResource(req)
@@ -174,6 +716,15 @@ func (f *Function) DedupeUser(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctio
 		return rsp, nil
 	}
 
+	// Source paths set by earlier steps live in the desired XR, while fields
+	// such as spec are only present on the observed XR.
+	observed, err := fieldpath.PaveObject(oxr.Resource)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to pave object")
+		response.Fatal(rsp, errors.Wrapf(err, fmt.Sprintf("cannot pave object %s", oxr.Resource)))
+		return rsp, nil
+	}
+
 	// Check groups priority nil
 	if len(in.GroupsPriority) == 0 {
 		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("No group priority found")
@@ -181,27 +732,43 @@ func (f *Function) DedupeUser(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctio
 		return rsp, nil
 	}
 
-	mapUser2DestPath := make(map[string]string)
-	// reverse loop to ensure that the last value of the map is the highest priority
-	for i := len(in.GroupsPriority) - 1; i >= 0; i-- {
-		transformData := in.GroupsPriority[i]
+	// Walk the priorities from the highest, so each user lands in the first
+	// destination listing it. Destinations and their users keep the order
+	// they were found in until arrangeUsers sorts them.
+	seen := map[string]bool{}
+	dests := []destination{}
+	mapToPath2UserList := make(map[destination][]any)
+	for _, transformData := range in.GroupsPriority {
+		dest := destination{path: transformData.ToPath, contextKey: transformData.ToContextKey}
+		var userLists [][]string
 		for _, fromPath := range transformData.FromPathsList {
 			userList, err := paved.GetStringArray(fromPath)
+			if fieldpath.IsNotFound(err) {
+				userList, err = observed.GetStringArray(fromPath)
+			}
 			if err != nil {
 				response.Normalf(rsp, "cannot get user list from composite field %s as error %s", fromPath, err.Error())
 			}
-			for _, user := range userList {
-				mapUser2DestPath[user] = transformData.ToPath
+			userLists = append(userLists, userList)
+		}
+		for _, key := range transformData.FromContextKeys {
+			userList, err := contextUsers(req, key)
+			if err != nil {
+				response.Normalf(rsp, "cannot get user list from context as error %s", err.Error())
 			}
+			userLists = append(userLists, userList)
 		}
-	}
-
-	mapToPath2UserList := make(map[string][]string)
-	for user, destPath := range mapUser2DestPath {
-		if _, ok := mapToPath2UserList[destPath]; !ok {
-			mapToPath2UserList[destPath] = []string{}
+		for _, user := range lo.Flatten(userLists) {
+			key := dedupeKey(user, in.IgnoreEmailCase)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, ok := mapToPath2UserList[dest]; !ok {
+				dests = append(dests, dest)
+			}
+			mapToPath2UserList[dest] = append(mapToPath2UserList[dest], user)
 		}
-		mapToPath2UserList[destPath] = append(mapToPath2UserList[destPath], user)
 	}
 
 	paved, err = fieldpath.PaveObject(dxr.Resource)
@@ -210,13 +777,100 @@ func (f *Function) DedupeUser(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctio
 		response.Fatal(rsp, errors.Wrapf(err, fmt.Sprintf("cannot pave object %s", dxr.Resource)))
 		return rsp, nil
 	}
-	for destPath, userList := range mapToPath2UserList {
-		fmt.Println(userList)
-		err = paved.MergeValue(destPath, userList, nil)
+	for _, dest := range dests {
+		if dest.path != "" {
+			f.writeUsers(rsp, paved, observed, dest.path, mapToPath2UserList[dest], in)
+		}
+		if dest.contextKey != "" {
+			if err := setContextUsers(rsp, dest.contextKey, arrangeUsers(mapToPath2UserList[dest], in)); err != nil {
+				response.Normalf(rsp, "failed to write users to context key %s with err %s", dest.contextKey, err.Error())
+			}
+		}
+	}
+
+	if err = response.SetDesiredCompositeResource(rsp, dxr); err != nil {
+		response.Fatal(rsp, errors.Wrapf(err, "cannot set desired composite resource in %T", rsp))
+		return rsp, nil
+	}
+
+	response.ConditionTrue(rsp, "FunctionSuccess", "Success").
+		TargetCompositeAndClaim()
+
+	return rsp, nil
+}
+
+// CombineUsers evaluates set expressions over user lists in the XR and patches
+// the results to the desired resource
+func (f *Function) CombineUsers(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) (*fnv1.RunFunctionResponse, error) {
+	dxr, err := request.GetDesiredCompositeResource(req)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to get DXR")
+		response.Fatal(rsp, errors.Wrapf(err, "Failed to get DXR"))
+		return rsp, nil
+	}
+
+	// See DedupeUser for why the GVK is copied from the observed XR.
+	oxr, err := request.GetObservedCompositeResource(req)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot get observed composite resource"))
+		return rsp, nil
+	}
+	dxr.Resource.SetAPIVersion(oxr.Resource.GetAPIVersion())
+	dxr.Resource.SetKind(oxr.Resource.GetKind())
+
+	paved, err := fieldpath.PaveObject(dxr.Resource)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to pave object")
+		response.Fatal(rsp, errors.Wrapf(err, "cannot pave object %s", dxr.Resource))
+		return rsp, nil
+	}
+	observed, err := fieldpath.PaveObject(oxr.Resource)
+	if err != nil {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to pave object")
+		response.Fatal(rsp, errors.Wrapf(err, "cannot pave object %s", oxr.Resource))
+		return rsp, nil
+	}
+
+	if len(in.Combinations) == 0 {
+		response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("No combination found")
+		response.Fatal(rsp, errors.New("No combination found"))
+		return rsp, nil
+	}
+
+	for name := range in.UserSets {
+		if err := validateSetName(name); err != nil {
+			response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Invalid user set name")
+			response.Fatal(rsp, err)
+			return rsp, nil
+		}
+	}
+
+	// Lists missing from the XR are empty sets.
+	sets := make(map[string][]string, len(in.UserSets))
+	for _, name := range slices.Sorted(maps.Keys(in.UserSets)) {
+		fromPath := in.UserSets[name]
+		userList, err := paved.GetStringArray(fromPath)
+		if fieldpath.IsNotFound(err) {
+			userList, err = observed.GetStringArray(fromPath)
+		}
 		if err != nil {
-			response.Normalf(rsp, "failed to patch user to DXR with path %s with err %s", destPath, err.Error())
-			fmt.Println(err.Error())
+			response.Normalf(rsp, "cannot get user list from composite field %s as error %s", fromPath, err.Error())
 		}
+		sets[name] = userList
+	}
+
+	key := func(u string) string { return dedupeKey(u, in.IgnoreEmailCase) }
+	results := make([][]string, len(in.Combinations))
+	for i, c := range in.Combinations {
+		results[i], err = evalSetExpression(c.Expression, sets, key)
+		if err != nil {
+			response.ConditionFalse(rsp, "FunctionSuccess", "InternalError").TargetComposite().WithMessage("Failed to combine users")
+			response.Fatal(rsp, errors.Wrapf(err, "cannot evaluate expression for %s", c.ToPath))
+			return rsp, nil
+		}
+	}
+	for i, c := range in.Combinations {
+		f.writeUsers(rsp, paved, observed, c.ToPath, toAnySlice(results[i]), in)
 	}
 
 	if err = response.SetDesiredCompositeResource(rsp, dxr); err != nil {
@@ -229,3 +883,23 @@ func (f *Function) DedupeUser(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctio
 
 	return rsp, nil
 }
+
+// writeUsers arranges users as asked for by in, writes them to path in the
+// desired XR and reports how they differ from the observed ones.
+func (f *Function) writeUsers(rsp *fnv1.RunFunctionResponse, desired, observed *fieldpath.Paved, path string, users []any, in *v1beta1.Input) {
+	userList := arrangeUsers(users, in)
+	if err := desired.MergeValue(path, userList, nil); err != nil {
+		response.Normalf(rsp, "failed to patch user to DXR with path %s with err %s", path, err.Error())
+		return
+	}
+
+	before, _ := observedUsers(observed, path)
+	change := diffMembers(before, userList, in.IgnoreEmailCase)
+	reportChanges(rsp, path, change, in.ChangeReport)
+	if in.ChangeReport != nil && in.ChangeReport.SummaryField != "" {
+		summaryPath := changeSummaryPath(in.ChangeReport.SummaryField, path)
+		if err := desired.SetValue(summaryPath, changeSummary(observed, summaryPath, change, f.now())); err != nil {
+			response.Normalf(rsp, "failed to patch change summary to DXR with path %s with err %s", summaryPath, err.Error())
+		}
+	}
+}
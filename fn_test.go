@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -11,6 +13,10 @@ import (
 	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/durationpb"
 
+	"github.com/crossplane/function-keycloak/client"
+	"github.com/crossplane/function-keycloak/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
 	"github.com/crossplane/function-sdk-go/logging"
 	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
 	"github.com/crossplane/function-sdk-go/resource"
@@ -18,17 +24,154 @@ import (
 )
 
 type KeyCloakMockClient struct {
+	config client.Config
 }
 
-func (c *KeyCloakMockClient) GetToken() (string, error) {
+func (c *KeyCloakMockClient) GetToken(_ context.Context) (string, error) {
 	return "1234", nil
 }
 
-func (c *KeyCloakMockClient) GetGroupMembers(groupName []string) ([]string, error) {
+func (c *KeyCloakMockClient) Close() {}
+
+func (c *KeyCloakMockClient) GetGroupMembers(ctx context.Context, realm string, groupName []string, opts client.GroupMembersOptions) (*client.GroupMembersResult, error) {
+	if realm == "" {
+		realm = c.config.Realm
+	}
+	if lo.Contains(groupName, "deleted") {
+		result, err := c.GetGroupMembers(ctx, realm, lo.Without(groupName, "deleted"), opts)
+		if err != nil {
+			return nil, err
+		}
+		result.Groups = append(result.Groups, client.GroupOutcome{Ref: "deleted", Missing: true})
+		return result, nil
+	}
+	for _, sel := range opts.Selectors {
+		if sel.Glob == "team-*" {
+			groupName = append(groupName, "chuan")
+		}
+	}
+	if lo.Contains(groupName, "slow") {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if lo.Contains(groupName, "mixed-case") {
+		return &client.GroupMembersResult{Members: []client.User{
+			{ID: "1", Email: "Bob@gmail.com"},
+			{ID: "2", Email: "alice@gmail.com"},
+			{ID: "3", Email: "bob@gmail.com"},
+			{ID: "2", Email: "alice@gmail.com"},
+			{ID: "4", Email: "Carol@gmail.com"},
+		}}, nil
+	}
+	if lo.Contains(groupName, "empty") {
+		return &client.GroupMembersResult{Members: []client.User{}}, nil
+	}
+	if lo.Contains(groupName, "down") {
+		return nil, fmt.Errorf("%w: 503 Service Unavailable", client.ErrUnavailable)
+	}
 	if lo.Contains(groupName, "chuan") {
-		return []string{"chuan@gmail.com", "hehe@gmail.com"}, nil
+		return &client.GroupMembersResult{Members: emailUsers("chuan@gmail.com", "hehe@gmail.com")}, nil
+	}
+	if lo.Contains(groupName, "mixed") {
+		users := []client.User{
+			{ID: "1", Username: "alice", Email: "alice@gmail.com"},
+			{ID: "2", Username: "bob"},
+			{ID: "3", Username: "carol", Attributes: map[string][]string{"iamEmail": {"carol@iam.example.com"}}},
+		}
+		if opts.IncludeFederatedIdentities {
+			users[1].FederatedIdentities = map[string]string{"github": "bob-gh"}
+		}
+		return &client.GroupMembersResult{Members: users}, nil
+	}
+	if lo.Contains(groupName, "objects") {
+		alice := client.User{
+			ID: "1", Username: "alice", Email: "alice@gmail.com", FirstName: "Alice", Enabled: true,
+			Attributes: map[string][]string{"department": {"platform"}, "secret": {"x"}},
+		}
+		bob := client.User{ID: "2", Username: "bob", Enabled: false, Groups: []string{"/objects"}}
+		aliceTop, aliceSub := alice, alice
+		aliceTop.Groups = []string{"/objects"}
+		aliceSub.Groups = []string{"/objects/sub"}
+		return &client.GroupMembersResult{Members: []client.User{aliceTop, bob, aliceSub}}, nil
+	}
+	if realm == "tenant" && lo.Contains(groupName, "tenant-admins") {
+		return &client.GroupMembersResult{Members: emailUsers("tenant@gmail.com")}, nil
+	}
+	if c.config.Url == "https://other.example.com" && realm == "team-b" && lo.Contains(groupName, "tenant-admins") {
+		return &client.GroupMembersResult{Members: emailUsers("team-b@gmail.com")}, nil
+	}
+	return &client.GroupMembersResult{}, nil
+}
+
+func (c *KeyCloakMockClient) GetRoleMembers(_ context.Context, _ string, roleNames []string, opts client.RoleMembersOptions) (*client.GroupMembersResult, error) {
+	if opts.ClientID == "app" && lo.Contains(roleNames, "app-admin") {
+		return &client.GroupMembersResult{Members: emailUsers("app-admin@gmail.com")}, nil
 	}
-	return nil, nil
+	if opts.ClientID == "" && lo.Contains(roleNames, "viewer") {
+		users := emailUsers("viewer@gmail.com")
+		if opts.IncludeGroupMembers {
+			users = append(users, emailUsers("viewer-group@gmail.com")...)
+		}
+		return &client.GroupMembersResult{Members: users}, nil
+	}
+	return &client.GroupMembersResult{}, nil
+}
+
+func (c *KeyCloakMockClient) GetOrganizationMembers(_ context.Context, _ string, orgNames []string, opts client.OrganizationMembersOptions) (*client.OrganizationMembersResult, error) {
+	result := &client.OrganizationMembersResult{GroupMembersResult: client.GroupMembersResult{Members: []client.User{}}, Domains: []string{}}
+	if lo.Contains(orgNames, "acme") {
+		if opts.MembershipType != client.MembershipUnmanaged {
+			result.Members = append(result.Members, emailUsers("alice@acme.com")...)
+		}
+		if opts.MembershipType != client.MembershipManaged {
+			result.Members = append(result.Members, emailUsers("bob@gmail.com")...)
+		}
+		result.Domains = append(result.Domains, "acme.com", "acme.io")
+	}
+	return result, nil
+}
+
+func (c *KeyCloakMockClient) GetUserMemberships(_ context.Context, _ string, userRefs []string, opts client.UserMembershipsOptions) (*client.UserMembershipsResult, error) {
+	result := &client.UserMembershipsResult{Memberships: map[string]client.UserMemberships{}}
+	for _, ref := range userRefs {
+		if ref != "chuan@gmail.com" {
+			result.Missing = append(result.Missing, ref)
+			continue
+		}
+		m := client.UserMemberships{
+			User:        client.User{ID: "1", Username: "chuan", Email: ref},
+			Groups:      []string{"/platform", "/platform/admins"},
+			RealmRoles:  []string{"admin", "viewer"},
+			ClientRoles: map[string][]string{},
+		}
+		for _, id := range opts.ClientIDs {
+			m.ClientRoles[id] = []string{id + "-admin"}
+		}
+		result.Memberships[ref] = m
+	}
+	return result, nil
+}
+
+func (c *KeyCloakMockClient) GetUsers(_ context.Context, _ string, userRefs []string) (*client.UsersResult, error) {
+	known := map[string]client.User{
+		"chuan@gmail.com": {ID: "1", Email: "chuan@gmail.com", Enabled: true},
+		"hehe@gmail.com":  {ID: "2", Email: "hehe@gmail.com", Enabled: false},
+	}
+	result := &client.UsersResult{Users: map[string]client.User{}}
+	for _, ref := range userRefs {
+		if u, ok := known[ref]; ok {
+			result.Users[ref] = u
+		} else {
+			result.Missing = append(result.Missing, ref)
+		}
+	}
+	return result, nil
+}
+
+func emailUsers(emails ...string) []client.User {
+	return lo.Map(emails, func(e string, _ int) client.User {
+		return client.User{ID: e, Username: e, Email: e}
+	})
 }
 
 func TestRunFunction(t *testing.T) {
@@ -100,46 +243,98 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
-		"ResponseIsReturnedTypeDedupeUser": {
-			reason: "The Function should return a fatal result if no input was specified",
+		"ResponseIsReturnedTypeFetchUserFromCredentials": {
+			reason: "The Function should connect with the settings from the step credentials",
 			args: args{
 				req: &fnv1.RunFunctionRequest{
 					Meta: &fnv1.RequestMeta{Tag: "hello"},
 					Input: resource.MustStructJSON(`{
 						"apiVersion": "template.fn.crossplane.io/v1beta1",
 						"kind": "Input",
-						"functionType": "DedupeUsers",
-						"groupsPriority": [
-							{
-								"fromPathsList": ["spec.adminUsers", "status.adminUsers"],
-								"toPath": "spec.adminUsers"
-							},
-							{
-								"fromPathsList": ["spec.editorUsers", "status.editorUsers"],
-								"toPath": "spec.editorUsers"
-							},
-							{
-								"fromPathsList": ["spec.viewerUsers", "status.viewerUsers"],
-								"toPath": "spec.viewerUsers"
-							}
-						]
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"credentialsName": "tenant-keycloak",
+						"outputField": "status.adminUsers"
 					}`),
+					Credentials: map[string]*fnv1.Credentials{
+						"tenant-keycloak": {
+							Source: &fnv1.Credentials_CredentialData{
+								CredentialData: &fnv1.CredentialData{
+									Data: map[string][]byte{
+										"realm":        []byte("tenant"),
+										"clientSecret": []byte("secret"),
+									},
+								},
+							},
+						},
+					},
 					Observed: &fnv1.State{
 						Composite: &fnv1.Resource{
 							Resource: resource.MustStructJSON(`{
-                                "apiVersion": "template.fn.crossplane.io/v1beta1",
-                                "kind": "Output",
-                                "spec": {
-									"adminUsers": ["chuan1@gmail.com", "chuan2@gmail.com"],
-									"editorUsers": ["chuan1@gmail.com", "chuan2@gmail.com"],
-									"viewerUsers": ["chuan1@gmail.com", "chuan2@gmail.com"]
-								},
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["tenant-admins"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
 								"status": {
-									"adminUsers": ["chuan1@gmail.com", "chuan3@gmail.com"],
-									"editorUsers": ["chuan1@gmail.com", "chuan2@gmail.com"],
-									"viewerUsers": ["chuan1@gmail.com", "chuan4@gmail.com"]
+									"adminUsers": ["tenant@gmail.com"]
 								}
-                            }`),
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserFromNamedConnectionAndCompositeRealm": {
+			reason: "The Function should use the named connection and the realm read from the XR",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"connection": "other",
+						"realm": "tenant",
+						"realmFromCompositeField": "spec.realm",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"realm": "team-b",
+									"adminOrgs" : ["tenant-admins"]
+								}
+							}`),
 						},
 					},
 				},
@@ -156,58 +351,86 @@ func TestRunFunction(t *testing.T) {
 						},
 					},
 					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["team-b@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserUnknownConnection": {
+			reason: "The Function should return a fatal result if the connection is not registered",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"connection": "missing",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
 						Composite: &fnv1.Resource{
 							Resource: resource.MustStructJSON(`{
 								"apiVersion": "template.fn.crossplane.io/v1beta1",
 								"kind": "Output",
 								"spec": {
-									"adminUsers": ["chuan1@gmail.com", "chuan2@gmail.com","chuan3@gmail.com"],
-									"viewerUsers": ["chuan4@gmail.com"]
+									"adminOrgs" : ["chuan"]
 								}
 							}`),
 						},
 					},
 				},
 			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "InternalError",
+							Message: ptr("Failed to get Keycloak client"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
 		},
-		"ResponseIsReturnedTypeDedupeUserCaseLackOfUser": {
-			reason: "The Function should return a fatal result if no input was specified",
+		"ResponseIsReturnedTypeFetchUserByUsername": {
+			reason: "The Function should write the selected identity of each user",
 			args: args{
 				req: &fnv1.RunFunctionRequest{
 					Meta: &fnv1.RequestMeta{Tag: "hello"},
 					Input: resource.MustStructJSON(`{
 						"apiVersion": "template.fn.crossplane.io/v1beta1",
 						"kind": "Input",
-						"functionType": "DedupeUsers",
-						"groupsPriority": [
-							{
-								"fromPathsList": ["spec.adminUsers", "status.adminUsers"],
-								"toPath": "spec.adminUsers"
-							},
-							{
-								"fromPathsList": ["spec.editorUsers", "status.editorUsers"],
-								"toPath": "spec.editorUsers"
-							},
-							{
-								"fromPathsList": ["spec.viewerUsers", "status.viewerUsers"],
-								"toPath": "spec.viewerUsers"
-							}
-						]
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs",
+							"identity": {"type": "Username"}
+						},
+						"functionType": "FetchUser",
+						"outputField": "status.adminUsers"
 					}`),
 					Observed: &fnv1.State{
 						Composite: &fnv1.Resource{
 							Resource: resource.MustStructJSON(`{
-                                "apiVersion": "template.fn.crossplane.io/v1beta1",
-                                "kind": "Output",
-                                "spec": {
-									"adminUsers": ["chuan1@gmail.com"],
-									"viewerUsers": ["chuan1@gmail.com", "chuan4@gmail.com"]
-								},
-								"status": {
-									"adminUsers": ["chuan1@gmail.com", "chuan2@gmail.com"],
-									"editorUsers": ["chuan1@gmail.com", "chuan2@gmail.com"]
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["mixed"]
 								}
-                            }`),
+							}`),
 						},
 					},
 				},
@@ -224,13 +447,69 @@ func TestRunFunction(t *testing.T) {
 						},
 					},
 					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["alice", "bob", "carol"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserIdentityFallback": {
+			reason: "Users without the selected identity should use the fallback and be skipped when that is missing too",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs",
+							"identity": {
+								"type": "Email",
+								"missingPolicy": "Fallback",
+								"fallback": {"type": "Attribute", "attribute": "iamEmail"}
+							}
+						},
+						"functionType": "FetchUser",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
 						Composite: &fnv1.Resource{
 							Resource: resource.MustStructJSON(`{
 								"apiVersion": "template.fn.crossplane.io/v1beta1",
 								"kind": "Output",
 								"spec": {
-									"adminUsers": ["chuan1@gmail.com", "chuan2@gmail.com"],
-									"viewerUsers": ["chuan4@gmail.com"]
+									"adminOrgs" : ["mixed"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["alice@gmail.com", "carol@iam.example.com"]
 								}
 							}`),
 						},
@@ -238,21 +517,2613 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
-	}
-
-	for name, tc := range cases {
-		t.Run(name, func(t *testing.T) {
-			keycloakClient := &KeyCloakMockClient{}
-			f := &Function{log: logging.NewNopLogger(), keycloakClient: keycloakClient}
-			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
-			less := func(a, b any) bool { return fmt.Sprintf("%s", a) < fmt.Sprintf("%s", b) }
-			rsp.Results = nil
-			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform(), cmpopts.SortSlices(less)); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
-			}
-
-			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+		"ResponseIsReturnedTypeFetchUserFederatedIdentitySkip": {
+			reason: "Users without a link to the identity provider should be skipped",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs",
+							"identity": {"type": "FederatedIdentity", "identityProvider": "github", "missingPolicy": "Skip"}
+						},
+						"functionType": "FetchUser",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["mixed"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["bob-gh"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserIdentityFail": {
+			reason: "A user without the selected identity should fail the step when asked to",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs",
+							"identity": {"type": "Email", "missingPolicy": "Fail"}
+						},
+						"functionType": "FetchUser",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["mixed"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "InternalError",
+							Message: ptr("Failed to get user identity"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserIdentityPlaceholder": {
+			reason: "Users without the selected identity should get the placeholder, written once",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs",
+							"identity": {"missingPolicy": "Placeholder", "placeholder": "unknown"}
+						},
+						"functionType": "FetchUser",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["mixed"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["alice@gmail.com", "unknown"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserObjects": {
+			reason: "The Function should write one object per user with the selected fields",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"outputField": "status.adminUsers",
+						"outputFormat": "Objects",
+						"userObject": {
+							"fields": ["username", "firstName", "enabled", "groups"],
+							"attributes": ["department"]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["objects"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": [
+										{
+											"username": "alice",
+											"firstName": "Alice",
+											"enabled": true,
+											"groups": ["/objects", "/objects/sub"],
+											"attributes": {"department": ["platform"]}
+										},
+										{
+											"username": "bob",
+											"firstName": "",
+											"enabled": false,
+											"groups": ["/objects"],
+											"attributes": {}
+										}
+									]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserTimeout": {
+			reason: "The Function should fail with a Timeout condition when Keycloak does not answer within the step timeout",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"timeout": "10ms",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["slow"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "Timeout",
+							Message: ptr("Timed out waiting for Keycloak"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserZeroTimeout": {
+			reason: "The Function should reject a timeout that would cancel every Keycloak call at once",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"timeout": "0s",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["platform"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "InternalError",
+							Message: ptr("Invalid timeout"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserKeycloakUnavailable": {
+			reason: "The Function should fail with a KeycloakUnavailable condition when Keycloak is down",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["down"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "KeycloakUnavailable",
+							Message: ptr("Keycloak is unavailable, retrying on the next reconcile"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserGuardrailRefuseEmpty": {
+			reason: "The Function should keep the observed users instead of writing an empty list",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"guardrails": {"refuseEmpty": true},
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["empty"]
+								},
+								"status": {
+									"adminUsers": ["a@gmail.com", "b@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "MembershipUpdated",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "GuardrailTripped",
+							Message: ptr("found no users to replace the 2 observed ones"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["a@gmail.com", "b@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserGuardrailMaxRemoval": {
+			reason: "The Function should keep the observed users when too many of them would be removed",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"guardrails": {"maxRemovalPercent": 50},
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["chuan"]
+								},
+								"status": {
+									"adminUsers": ["chuan@gmail.com", "a@gmail.com", "b@gmail.com", "c@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "MembershipUpdated",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "GuardrailTripped",
+							Message: ptr("would remove 3 of 4 observed users, more than the maximum of 50%"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["chuan@gmail.com", "a@gmail.com", "b@gmail.com", "c@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserGuardrailMaxRemovalWithinLimit": {
+			reason: "The Function should write the users when few enough of the observed ones are removed",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"guardrails": {"maxRemovalPercent": 50},
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["chuan"]
+								},
+								"status": {
+									"adminUsers": ["chuan@gmail.com", "hehe@gmail.com", "a@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["chuan@gmail.com", "hehe@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserGuardrailMinMembersNothingObserved": {
+			reason: "The Function should write nothing when too few users are found and the XR holds none",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"guardrails": {"minMembers": 3},
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["chuan"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "MembershipUpdated",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "GuardrailTripped",
+							Message: ptr("found 2 users, fewer than the minimum of 3"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output"
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserGuardrailOverridden": {
+			reason: "The Function should write the users when the XR overrides the guardrails",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"guardrails": {"refuseEmpty": true},
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"metadata": {
+									"annotations": {"keycloak.fn.crossplane.io/override-guardrails": "true"}
+								},
+								"spec": {
+									"adminOrgs" : ["empty"]
+								},
+								"status": {
+									"adminUsers": ["a@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": []
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserChangeSummary": {
+			reason: "The Function should summarize the users added and removed since the observed value",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"changeReport": {
+							"summaryField": "status.membershipChanges"
+						},
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["chuan"]
+								},
+								"status": {
+									"adminUsers": ["chuan@gmail.com", "old@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["chuan@gmail.com", "hehe@gmail.com"],
+									"membershipChanges": {
+										"status.adminUsers": {
+											"added": 1,
+											"removed": 1,
+											"unchanged": 1,
+											"lastChanged": "2024-01-02T03:04:05Z"
+										}
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserChangeSummaryUnchanged": {
+			reason: "The Function should keep the time of the last change when the users did not change",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"changeReport": {
+							"summaryField": "status.membershipChanges"
+						},
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["chuan"]
+								},
+								"status": {
+									"adminUsers": ["chuan@gmail.com", "hehe@gmail.com"],
+									"membershipChanges": {
+										"status.adminUsers": {
+											"added": 2,
+											"removed": 0,
+											"unchanged": 0,
+											"lastChanged": "2023-06-01T00:00:00Z"
+										}
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["chuan@gmail.com", "hehe@gmail.com"],
+									"membershipChanges": {
+										"status.adminUsers": {
+											"added": 0,
+											"removed": 0,
+											"unchanged": 2,
+											"lastChanged": "2023-06-01T00:00:00Z"
+										}
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeDedupeUserChangeSummary": {
+			reason: "The Function should summarize the changes of every path it writes",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"functionType": "DedupeUsers",
+						"changeReport": {
+							"summaryField": "status.membershipChanges"
+						},
+						"groupsPriority": [
+							{
+								"fromPathsList": ["spec.adminUsers"],
+								"toPath": "status.adminUsers"
+							}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminUsers": ["chuan1@gmail.com"]
+								},
+								"status": {
+									"adminUsers": ["chuan2@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["chuan1@gmail.com"],
+									"membershipChanges": {
+										"status.adminUsers": {
+											"added": 1,
+											"removed": 1,
+											"unchanged": 0,
+											"lastChanged": "2024-01-02T03:04:05Z"
+										}
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeDedupeUser": {
+			reason: "The Function should return a fatal result if no input was specified",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"functionType": "DedupeUsers",
+						"groupsPriority": [
+							{
+								"fromPathsList": ["spec.adminUsers", "status.adminUsers"],
+								"toPath": "spec.adminUsers"
+							},
+							{
+								"fromPathsList": ["spec.editorUsers", "status.editorUsers"],
+								"toPath": "spec.editorUsers"
+							},
+							{
+								"fromPathsList": ["spec.viewerUsers", "status.viewerUsers"],
+								"toPath": "spec.viewerUsers"
+							}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+                                "apiVersion": "template.fn.crossplane.io/v1beta1",
+                                "kind": "Output",
+                                "spec": {
+									"adminUsers": ["chuan1@gmail.com", "chuan2@gmail.com"],
+									"editorUsers": ["chuan1@gmail.com", "chuan2@gmail.com"],
+									"viewerUsers": ["chuan1@gmail.com", "chuan2@gmail.com"]
+								},
+								"status": {
+									"adminUsers": ["chuan1@gmail.com", "chuan3@gmail.com"],
+									"editorUsers": ["chuan1@gmail.com", "chuan2@gmail.com"],
+									"viewerUsers": ["chuan1@gmail.com", "chuan4@gmail.com"]
+								}
+                            }`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminUsers": ["chuan1@gmail.com", "chuan2@gmail.com","chuan3@gmail.com"],
+									"viewerUsers": ["chuan4@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeDedupeUserCaseLackOfUser": {
+			reason: "The Function should return a fatal result if no input was specified",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"functionType": "DedupeUsers",
+						"groupsPriority": [
+							{
+								"fromPathsList": ["spec.adminUsers", "status.adminUsers"],
+								"toPath": "spec.adminUsers"
+							},
+							{
+								"fromPathsList": ["spec.editorUsers", "status.editorUsers"],
+								"toPath": "spec.editorUsers"
+							},
+							{
+								"fromPathsList": ["spec.viewerUsers", "status.viewerUsers"],
+								"toPath": "spec.viewerUsers"
+							}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+                                "apiVersion": "template.fn.crossplane.io/v1beta1",
+                                "kind": "Output",
+                                "spec": {
+									"adminUsers": ["chuan1@gmail.com"],
+									"viewerUsers": ["chuan1@gmail.com", "chuan4@gmail.com"]
+								},
+								"status": {
+									"adminUsers": ["chuan1@gmail.com", "chuan2@gmail.com"],
+									"editorUsers": ["chuan1@gmail.com", "chuan2@gmail.com"]
+								}
+                            }`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminUsers": ["chuan1@gmail.com", "chuan2@gmail.com"],
+									"viewerUsers": ["chuan4@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchRealmRoleUsers": {
+			reason: "The Function should patch the users holding the realm roles, including the members of groups granted them",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"roleList": {
+							"fromCompositeField": "spec.viewerRoles",
+							"includeGroupMembers": true
+						},
+						"functionType": "FetchRealmRoleUsers",
+						"outputField": "spec.viewerUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"viewerRoles": ["viewer"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"viewerUsers": ["viewer@gmail.com", "viewer-group@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchClientRoleUsers": {
+			reason: "The Function should patch the users holding the roles of the client",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"roleList": {
+							"fromCompositeField": "spec.appRoles",
+							"clientId": "app"
+						},
+						"functionType": "FetchClientRoleUsers",
+						"outputField": "spec.appAdmins"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"appRoles": ["app-admin"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"appAdmins": ["app-admin@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchClientRoleUsersWithoutClient": {
+			reason: "The Function should return a fatal result if no client is given for client roles",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"roleList": {
+							"fromCompositeField": "spec.appRoles"
+						},
+						"functionType": "FetchClientRoleUsers",
+						"outputField": "spec.appAdmins"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"appRoles": ["app-admin"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "InternalError",
+							Message: ptr("No client found"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchOrganizationUsers": {
+			reason: "The Function should patch the members of the organizations, and their domains when asked for",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"organizationList": {
+							"fromCompositeField": "spec.tenants",
+							"domainsField": "spec.tenantDomains"
+						},
+						"functionType": "FetchOrganizationUsers",
+						"outputField": "spec.tenantUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"tenants": ["acme"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"tenantUsers": ["alice@acme.com", "bob@gmail.com"],
+									"tenantDomains": ["acme.com", "acme.io"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchOrganizationUsersManaged": {
+			reason: "The Function should only patch the managed members of the organizations when asked for",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"organizationList": {
+							"fromCompositeField": "spec.tenants",
+							"membershipType": "Managed"
+						},
+						"functionType": "FetchOrganizationUsers",
+						"outputField": "spec.tenantUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"tenants": ["acme"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"tenantUsers": ["alice@acme.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserMemberships": {
+			reason: "The Function should patch the groups and roles of the users found, keyed by user",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"userList": {
+							"fromCompositeField": "spec.owners",
+							"clientIds": ["app"]
+						},
+						"functionType": "FetchUserMemberships",
+						"outputField": "status.owners"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"owners": ["chuan@gmail.com", "nobody@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"owners": {
+										"chuan@gmail.com": {
+											"id": "1",
+											"username": "chuan",
+											"email": "chuan@gmail.com",
+											"groups": ["/platform", "/platform/admins"],
+											"realmRoles": ["admin", "viewer"],
+											"clientRoles": {
+												"app": ["app-admin"]
+											}
+										}
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeValidateUsersUnknown": {
+			reason: "The Function should set the UsersValid condition to False listing users that do not exist or are disabled",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"userList": {
+							"fromCompositeField": "spec.owners"
+						},
+						"functionType": "ValidateUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"owners": ["chuan@gmail.com", "hehe@gmail.com", "chaun@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "UsersValid",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "UnknownUsers",
+							Message: ptr("Unknown users in spec.owners: hehe@gmail.com (disabled), chaun@gmail.com (not found)"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output"
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeValidateUsersKnown": {
+			reason: "The Function should set the UsersValid condition to True when every user is known",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"userList": {
+							"fromCompositeField": "spec.owners"
+						},
+						"functionType": "ValidateUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"owners": ["chuan@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "UsersValid",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "AllUsersKnown",
+							Target: fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output"
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeValidateUsersFilter": {
+			reason: "The Function should only write the known users in Filter mode",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"userList": {
+							"fromCompositeField": "spec.owners"
+						},
+						"validation": {
+							"mode": "Filter"
+						},
+						"functionType": "ValidateUsers",
+						"outputField": "status.owners"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"owners": ["chuan@gmail.com", "hehe@gmail.com", "chaun@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"owners": ["chuan@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeValidateUsersFilterWithoutOutput": {
+			reason: "The Function should return a fatal result if there is nowhere to write the filtered users",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"userList": {
+							"fromCompositeField": "spec.owners"
+						},
+						"validation": {
+							"mode": "Filter"
+						},
+						"functionType": "ValidateUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"owners": ["chuan@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "InternalError",
+							Message: ptr("No output field found"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserFilter": {
+			reason: "The Function should leave out the members not matching the filter",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs",
+							"filter": {
+								"enabledOnly": true
+							},
+							"identity": {
+								"type": "Username"
+							}
+						},
+						"functionType": "FetchUser",
+						"outputField": "spec.status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["objects"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"status": {
+										"adminUsers": ["alice"]
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserSelectors": {
+			reason: "The Function should fetch the members of the groups selectors pick without a group list in the XR",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"selectors": [
+								{"glob": "team-*"}
+							]
+						},
+						"functionType": "FetchUser",
+						"outputField": "spec.status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"status": {
+										"adminUsers": ["chuan@gmail.com", "hehe@gmail.com"]
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserMissingGroup": {
+			reason: "The Function should fail when a listed group does not exist",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["chuan", "deleted"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "InternalError",
+							Message: ptr("Failed to get list user"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserMissingGroupWarn": {
+			reason: "The Function should leave out groups that do not exist when asked to warn",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs",
+							"missingGroupPolicy": "Warn"
+						},
+						"functionType": "FetchUser",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["chuan", "deleted"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["chuan@gmail.com", "hehe@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserGroupTemplates": {
+			reason: "The Function should fetch the members of the groups listed in the Input and rendered from the XR",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"groups": ["/static"],
+							"templates": ["{{ .metadata.labels.team }}"]
+						},
+						"functionType": "FetchUser",
+						"outputField": "status.adminUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"metadata": {
+									"labels": {"team": "chuan"}
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["chuan@gmail.com", "hehe@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserOutputContextKey": {
+			reason: "The Function should write the users to the pipeline context instead of the XR when asked to",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"sources": [
+								{"fromContextKey": "example.org/groups"}
+							]
+						},
+						"functionType": "FetchUser",
+						"outputContextKey": "example.org/admins"
+					}`),
+					Context: resource.MustStructJSON(`{
+						"example.org/groups": ["chuan"]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output"
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"example.org/groups": ["chuan"],
+						"example.org/admins": ["chuan@gmail.com", "hehe@gmail.com"]
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output"
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeDedupeUserContext": {
+			reason: "The Function should dedupe user lists read from the pipeline context and write them back to it",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"functionType": "DedupeUsers",
+						"groupsPriority": [
+							{
+								"fromContextKeys": ["example.org/admins"],
+								"toContextKey": "example.org/deduped-admins"
+							},
+							{
+								"fromPathsList": ["spec.viewers"],
+								"fromContextKeys": ["example.org/viewers"],
+								"toPath": "status.viewers"
+							}
+						]
+					}`),
+					Context: resource.MustStructJSON(`{
+						"example.org/admins": ["chuan@gmail.com"],
+						"example.org/viewers": ["hehe@gmail.com", "chuan@gmail.com"]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"viewers": ["haha@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"example.org/admins": ["chuan@gmail.com"],
+						"example.org/viewers": ["hehe@gmail.com", "chuan@gmail.com"],
+						"example.org/deduped-admins": ["chuan@gmail.com"]
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"viewers": ["haha@gmail.com", "hehe@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserFromEnvironment": {
+			reason: "The Function should connect to the Keycloak url and realm of the environment over those of the credentials",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"environment": {
+							"urlField": "keycloak.url",
+							"realmField": "keycloak.realm"
+						},
+						"outputField": "status.adminUsers"
+					}`),
+					Credentials: map[string]*fnv1.Credentials{
+						"keycloak": {
+							Source: &fnv1.Credentials_CredentialData{
+								CredentialData: &fnv1.CredentialData{
+									Data: map[string][]byte{
+										"url":          []byte("https://prod.example.com"),
+										"realm":        []byte("tenant"),
+										"clientSecret": []byte("secret"),
+									},
+								},
+							},
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"apiextensions.crossplane.io/environment": {
+							"keycloak": {
+								"url": "https://other.example.com",
+								"realm": "team-b"
+							}
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["tenant-admins"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"apiextensions.crossplane.io/environment": {
+							"keycloak": {
+								"url": "https://other.example.com",
+								"realm": "team-b"
+							}
+						}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"status": {
+									"adminUsers": ["team-b@gmail.com"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"ResponseIsReturnedTypeFetchUserMissingEnvironmentField": {
+			reason: "The Function should fail rather than connect elsewhere when the environment lacks a setting",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "template.fn.crossplane.io/v1beta1",
+						"kind": "Input",
+						"groupList": {
+							"fromCompositeField": "spec.adminOrgs"
+						},
+						"functionType": "FetchUser",
+						"environment": {
+							"urlField": "keycloak.url"
+						},
+						"outputField": "status.adminUsers"
+					}`),
+					Context: resource.MustStructJSON(`{
+						"apiextensions.crossplane.io/environment": {
+							"region": "eu"
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "template.fn.crossplane.io/v1beta1",
+								"kind": "Output",
+								"spec": {
+									"adminOrgs" : ["chuan"]
+								}
+							}`),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "InternalError",
+							Message: ptr("Failed to get Keycloak client"),
+							Target:  fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"apiextensions.crossplane.io/environment": {
+							"region": "eu"
+						}
+					}`),
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			clients := client.NewPool(func(cfg client.Config) client.KeycloakClientInterface {
+				return &KeyCloakMockClient{config: cfg}
+			})
+			connections := client.NewRegistry()
+			connections.Register("other", client.Config{Url: "https://other.example.com", Realm: "master"})
+			now := func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+			f := &Function{log: logging.NewNopLogger(), connections: connections, clients: clients, now: now}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+			less := func(a, b any) bool { return fmt.Sprintf("%s", a) < fmt.Sprintf("%s", b) }
+			rsp.Results = nil
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform(), cmpopts.SortSlices(less)); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestGuardrailViolation(t *testing.T) {
+	g := &v1beta1.Guardrails{MaxRemovalPercent: ptr(50)}
+	observed := []any{"A@example.com", "B@example.com", "c@example.com"}
+	output := []any{"a@example.com", "b@example.com", "c@example.com"}
+
+	cases := map[string]struct {
+		reason          string
+		ignoreEmailCase bool
+		want            string
+	}{
+		"CaseSensitive": {
+			reason: "Emails changing case should count as removals by default",
+			want:   "would remove 2 of 3 observed users, more than the maximum of 50%",
+		},
+		"IgnoreEmailCase": {
+			reason:          "Emails changing case should not count as removals with ignoreEmailCase",
+			ignoreEmailCase: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, guardrailViolation(g, observed, output, tc.ignoreEmailCase)); diff != "" {
+				t.Errorf("%s\nguardrailViolation(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestReportChanges(t *testing.T) {
+	type args struct {
+		observed        []any
+		output          []any
+		cr              *v1beta1.ChangeReport
+		ignoreEmailCase bool
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   []string
+	}{
+		"AddedAndRemoved": {
+			reason: "Added and removed users should be named in separate results",
+			args: args{
+				observed: []any{"a@gmail.com", "b@gmail.com"},
+				output:   []any{"b@gmail.com", "c@gmail.com"},
+			},
+			want: []string{
+				"Added 1 users to status.adminUsers: c@gmail.com",
+				"Removed 1 users from status.adminUsers: a@gmail.com",
+			},
+		},
+		"Capped": {
+			reason: "Users beyond MaxListed should only be counted",
+			args: args{
+				output: []any{"a@gmail.com", "b@gmail.com", "c@gmail.com"},
+				cr:     &v1beta1.ChangeReport{MaxListed: ptr(2)},
+			},
+			want: []string{
+				"Added 3 users to status.adminUsers: a@gmail.com, b@gmail.com and 1 more",
+			},
+		},
+		"Objects": {
+			reason: "User objects should be matched by id and named by username",
+			args: args{
+				observed: []any{map[string]any{"id": "1", "username": "alice", "email": "old@gmail.com"}},
+				output:   []any{map[string]any{"id": "1", "username": "alice", "email": "alice@gmail.com"}, map[string]any{"id": "2", "username": "bob"}},
+			},
+			want: []string{
+				"Added 1 users to status.adminUsers: bob",
+			},
+		},
+		"Unchanged": {
+			reason: "Nothing should be reported when the users did not change",
+			args: args{
+				observed: []any{"a@gmail.com"},
+				output:   []any{"a@gmail.com"},
+			},
+		},
+		"IgnoreEmailCase": {
+			reason: "Emails differing only in case should not be reported when ignoreEmailCase is set",
+			args: args{
+				observed:        []any{"Alice@Gmail.com"},
+				output:          []any{"alice@gmail.com"},
+				ignoreEmailCase: true,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rsp := &fnv1.RunFunctionResponse{}
+			reportChanges(rsp, "status.adminUsers", diffMembers(tc.args.observed, tc.args.output, tc.args.ignoreEmailCase), tc.args.cr)
+			got := lo.Map(rsp.GetResults(), func(r *fnv1.Result, _ int) string { return r.GetMessage() })
+			if diff := cmp.Diff(tc.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("%s\nreportChanges(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestFilterUsers(t *testing.T) {
+	users := []client.User{
+		{ID: "1", Username: "alice", Email: "alice@example.com", Enabled: true, EmailVerified: true, Attributes: map[string][]string{"department": {"platform"}}},
+		{ID: "2", Username: "bob", Email: "bob@example.com", EmailVerified: true},
+		{ID: "3", Username: "carol", Email: "carol@eng.example.com", Enabled: true},
+		{ID: "4", Username: "service-account-app", Enabled: true, EmailVerified: true},
+		{ID: "5", Username: "dave", Email: "dave@CONTRACTOR.io", Enabled: true, EmailVerified: true, Attributes: map[string][]string{"department": {"sales", "platform"}}},
+	}
+
+	cases := map[string]struct {
+		reason      string
+		filter      *v1beta1.UserFilter
+		wantKept    []string
+		wantDropped []string
+	}{
+		"NoFilter": {
+			reason:   "Every user should be kept without a filter",
+			wantKept: []string{"1", "2", "3", "4", "5"},
+		},
+		"State": {
+			reason:      "Disabled, unverified and service account users should be left out when asked for",
+			filter:      &v1beta1.UserFilter{EnabledOnly: true, EmailVerifiedOnly: true, ExcludeServiceAccounts: true},
+			wantKept:    []string{"1", "5"},
+			wantDropped: []string{"bob (disabled)", "carol (email not verified)", "service-account-app (service account)"},
+		},
+		"Attributes": {
+			reason:      "Users should hold the required value of every attribute",
+			filter:      &v1beta1.UserFilter{Attributes: map[string]string{"department": "platform"}},
+			wantKept:    []string{"1", "5"},
+			wantDropped: []string{"bob (attribute department is not platform)", "carol (attribute department is not platform)", "service-account-app (attribute department is not platform)"},
+		},
+		"AllowedEmailDomains": {
+			reason:      "Users outside the allowed domains and their subdomains, or without an email, should be left out",
+			filter:      &v1beta1.UserFilter{AllowedEmailDomains: []string{"example.com"}},
+			wantKept:    []string{"1", "2", "3"},
+			wantDropped: []string{"service-account-app (email domain not allowed)", "dave (email domain not allowed)"},
+		},
+		"DeniedEmailDomains": {
+			reason:      "Users in a denied domain should be left out whatever the case of their email",
+			filter:      &v1beta1.UserFilter{DeniedEmailDomains: []string{"contractor.io"}},
+			wantKept:    []string{"1", "2", "3", "4"},
+			wantDropped: []string{"dave (email domain denied)"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			kept, dropped := filterUsers(users, tc.filter)
+			if diff := cmp.Diff(tc.wantKept, lo.Map(kept, func(u client.User, _ int) string { return u.ID })); diff != "" {
+				t.Errorf("%s\nfilterUsers(...): -want kept, +got kept:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantDropped, dropped); diff != "" {
+				t.Errorf("%s\nfilterUsers(...): -want dropped, +got dropped:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	users := []string{"alice", "bob", "carol"}
+	cases := map[string]struct {
+		reason    string
+		maxListed int
+		want      string
+	}{
+		"AllListed": {
+			reason:    "Every user should be named when there are no more than maxListed",
+			maxListed: 3,
+			want:      ": alice, bob, carol",
+		},
+		"Capped": {
+			reason:    "Users past maxListed should only be counted",
+			maxListed: 2,
+			want:      ": alice, bob and 1 more",
+		},
+		"Zero": {
+			reason:    "No user should be named when maxListed is zero",
+			maxListed: 0,
+			want:      "",
+		},
+		"Negative": {
+			reason:    "A negative maxListed should name no user rather than panic",
+			maxListed: -1,
+			want:      "",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, listUsers(users, tc.maxListed)); diff != "" {
+				t.Errorf("%s\nlistUsers(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestMissingGroups(t *testing.T) {
+	cases := map[string]struct {
+		reason       string
+		policy       v1beta1.MissingGroupPolicy
+		wantWarnings []string
+		wantErr      string
+	}{
+		"Default": {
+			reason:       "A missing group should fail the lookup by default",
+			wantWarnings: []string{`group selector glob "none-*" matches no group in realm r`},
+			wantErr:      "group gone not exists in realm r",
+		},
+		"LowercaseWarn": {
+			reason:       "Lowercase policies should be accepted, since Crossplane does not validate the input",
+			policy:       "warn",
+			wantWarnings: []string{`group selector glob "none-*" matches no group in realm r`, "group gone not exists in realm r, leaving it out"},
+		},
+		"Ignore": {
+			reason: "Ignored missing groups and selectors matching no group should be left out silently",
+			policy: "IGNORE",
+		},
+		"Unknown": {
+			reason:  "An unknown policy should be rejected rather than treated as Fail",
+			policy:  "skip",
+			wantErr: `unknown missingGroupPolicy "skip", want Fail, Warn or Ignore`,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			members := &client.GroupMembersResult{
+				Groups:    []client.GroupOutcome{{Ref: "here", Path: "/here"}, {Ref: "gone", Missing: true}},
+				Unmatched: []client.GroupSelector{{Glob: "none-*"}},
+			}
+			policy, err := parseMissingGroupPolicy(tc.policy)
+			if err == nil {
+				err = missingGroups(members, "r", policy)
+			}
+			var gotErr string
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if diff := cmp.Diff(tc.wantErr, gotErr); diff != "" {
+				t.Errorf("%s\nmissingGroups(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.wantWarnings, members.Warnings); diff != "" {
+				t.Errorf("%s\nmissingGroups(...): -want warnings, +got warnings:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestGroupNames(t *testing.T) {
+	xr := fieldpath.Pave(map[string]any{
+		"metadata": map[string]any{"name": "shop", "labels": map[string]any{"team": "platform"}},
+		"spec": map[string]any{
+			"teams":  []any{"/teams/a", "/teams/b"},
+			"owners": []any{map[string]any{"group": map[string]any{"name": "/owners/a"}}, map[string]any{"group": map[string]any{"name": "/teams/a"}}},
+			"bad":    []any{1},
+		},
+	})
+	req := &fnv1.RunFunctionRequest{Context: resource.MustStructJSON(`{"teams": [{"name": "/teams/c"}]}`)}
+
+	cases := map[string]struct {
+		reason    string
+		groupList v1beta1.GroupList
+		want      []string
+		wantErr   bool
+	}{
+		"Merged": {
+			reason: "Literal groups, rendered templates and sources in the XR or context should be merged in that order, each listed once",
+			groupList: v1beta1.GroupList{
+				Groups:    []string{"/static"},
+				Templates: []string{"{{ .metadata.labels.team }}-admins", "/apps/{{ .metadata.name }}"},
+				Sources: []v1beta1.GroupSource{
+					{FromCompositeField: "spec.teams"},
+					{FromCompositeField: "spec.owners", NameField: "group.name"},
+					{FromContextKey: "teams", NameField: "name"},
+				},
+			},
+			want: []string{"/static", "platform-admins", "/apps/shop", "/teams/a", "/teams/b", "/owners/a", "/teams/c"},
+		},
+		"MissingContextKey": {
+			reason:    "A context key earlier steps did not set should fail",
+			groupList: v1beta1.GroupList{Sources: []v1beta1.GroupSource{{FromContextKey: "missing"}}},
+			wantErr:   true,
+		},
+		"MissingTemplateField": {
+			reason:    "A template referencing a field the XR does not hold should fail rather than render <no value>",
+			groupList: v1beta1.GroupList{Templates: []string{"{{ .metadata.labels.owner }}-admins"}},
+			wantErr:   true,
+		},
+		"ObjectsWithoutNameField": {
+			reason:    "Objects should not be read without a nameField",
+			groupList: v1beta1.GroupList{Sources: []v1beta1.GroupSource{{FromCompositeField: "spec.owners"}}},
+			wantErr:   true,
+		},
+		"NotGroups": {
+			reason:    "Array items that are neither strings nor objects should fail",
+			groupList: v1beta1.GroupList{Sources: []v1beta1.GroupSource{{FromCompositeField: "spec.bad"}}},
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			templates, err := parseGroupTemplates(tc.groupList.Templates)
+			if err != nil {
+				t.Fatalf("parseGroupTemplates(...): %v", err)
+			}
+			got, err := groupNames(req, xr, tc.groupList, templates)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("%s\ngroupNames(...): want error %t, got %v", tc.reason, tc.wantErr, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\ngroupNames(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionOrder(t *testing.T) {
+	type args struct {
+		input    string
+		observed string
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		path   string
+		want   []string
+	}{
+		"FetchUserInputOrder": {
+			reason: "Users should keep the order they were found in, each written once",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "FetchUser", "groupList": {"fromCompositeField": "spec.adminOrgs"}, "outputField": "status.adminUsers"}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"adminOrgs": ["mixed-case"]}}`,
+			},
+			path: "status.adminUsers",
+			want: []string{"Bob@gmail.com", "alice@gmail.com", "bob@gmail.com", "Carol@gmail.com"},
+		},
+		"FetchUserAlphabetical": {
+			reason: "Users should be sorted by byte value",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "FetchUser", "sortOrder": "Alphabetical", "groupList": {"fromCompositeField": "spec.adminOrgs"}, "outputField": "status.adminUsers"}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"adminOrgs": ["mixed-case"]}}`,
+			},
+			path: "status.adminUsers",
+			want: []string{"Bob@gmail.com", "Carol@gmail.com", "alice@gmail.com", "bob@gmail.com"},
+		},
+		"FetchUserCaseInsensitive": {
+			reason: "Users should be sorted ignoring case",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "FetchUser", "sortOrder": "CaseInsensitive", "groupList": {"fromCompositeField": "spec.adminOrgs"}, "outputField": "status.adminUsers"}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"adminOrgs": ["mixed-case"]}}`,
+			},
+			path: "status.adminUsers",
+			want: []string{"alice@gmail.com", "Bob@gmail.com", "bob@gmail.com", "Carol@gmail.com"},
+		},
+		"FetchUserIgnoreEmailCase": {
+			reason: "Emails differing only in case should be written once",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "FetchUser", "sortOrder": "CaseInsensitive", "ignoreEmailCase": true, "groupList": {"fromCompositeField": "spec.adminOrgs"}, "outputField": "status.adminUsers"}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"adminOrgs": ["mixed-case"]}}`,
+			},
+			path: "status.adminUsers",
+			want: []string{"alice@gmail.com", "Bob@gmail.com", "Carol@gmail.com"},
+		},
+		"DedupeUserInputOrder": {
+			reason: "Users should keep the order of the priorities and source paths",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "DedupeUsers", "groupsPriority": [{"fromPathsList": ["spec.adminUsers"], "toPath": "status.adminUsers"}, {"fromPathsList": ["spec.viewerUsers", "spec.extraUsers"], "toPath": "status.viewerUsers"}]}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"adminUsers": ["z@gmail.com", "b@gmail.com"], "viewerUsers": ["y@gmail.com", "b@gmail.com", "a@gmail.com"], "extraUsers": ["c@gmail.com", "Y@gmail.com"]}}`,
+			},
+			path: "status.viewerUsers",
+			want: []string{"y@gmail.com", "a@gmail.com", "c@gmail.com", "Y@gmail.com"},
+		},
+		"DedupeUserCaseInsensitive": {
+			reason: "DedupeUsers should sort and drop emails differing only in case the same way",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "DedupeUsers", "sortOrder": "CaseInsensitive", "ignoreEmailCase": true, "groupsPriority": [{"fromPathsList": ["spec.adminUsers"], "toPath": "status.adminUsers"}, {"fromPathsList": ["spec.viewerUsers", "spec.extraUsers"], "toPath": "status.viewerUsers"}]}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"adminUsers": ["z@gmail.com", "B@gmail.com"], "viewerUsers": ["y@gmail.com", "b@gmail.com", "a@gmail.com"], "extraUsers": ["c@gmail.com", "Y@gmail.com"]}}`,
+			},
+			path: "status.viewerUsers",
+			want: []string{"a@gmail.com", "c@gmail.com", "y@gmail.com"},
+		},
+		"CombineUsersUnionDifference": {
+			reason: "Operators should apply left to right",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "CombineUsers", "userSets": {"admins": "spec.admins", "sre": "spec.sre", "contractors": "spec.contractors", "missing": "spec.missing"}, "combinations": [{"expression": "admins ∪ sre − contractors", "toPath": "status.users"}]}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"admins": ["a@gmail.com", "c@gmail.com"], "sre": ["b@gmail.com", "C@gmail.com", "d@gmail.com"], "contractors": ["d@gmail.com"]}}`,
+			},
+			path: "status.users",
+			want: []string{"a@gmail.com", "c@gmail.com", "b@gmail.com", "C@gmail.com"},
+		},
+		"CombineUsersIgnoreEmailCase": {
+			reason: "Sets should compare emails ignoring case when asked to",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "CombineUsers", "ignoreEmailCase": true, "userSets": {"admins": "spec.admins", "sre": "spec.sre", "contractors": "spec.contractors", "missing": "spec.missing"}, "combinations": [{"expression": "admins | sre - contractors", "toPath": "status.users"}]}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"admins": ["a@gmail.com", "c@gmail.com"], "sre": ["b@gmail.com", "C@gmail.com", "d@gmail.com"], "contractors": ["d@gmail.com"]}}`,
+			},
+			path: "status.users",
+			want: []string{"a@gmail.com", "c@gmail.com", "b@gmail.com"},
+		},
+		"CombineUsersPrecedence": {
+			reason: "Intersection should bind tighter than union",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "CombineUsers", "ignoreEmailCase": true, "userSets": {"admins": "spec.admins", "sre": "spec.sre", "contractors": "spec.contractors", "missing": "spec.missing"}, "combinations": [{"expression": "contractors | admins & sre", "toPath": "status.users"}]}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"admins": ["a@gmail.com", "c@gmail.com"], "sre": ["b@gmail.com", "C@gmail.com", "d@gmail.com"], "contractors": ["d@gmail.com"]}}`,
+			},
+			path: "status.users",
+			want: []string{"d@gmail.com", "c@gmail.com"},
+		},
+		"CombineUsersParentheses": {
+			reason: "Parentheses should group",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "CombineUsers", "userSets": {"admins": "spec.admins", "sre": "spec.sre", "contractors": "spec.contractors", "missing": "spec.missing"}, "combinations": [{"expression": "(contractors | admins) & sre", "toPath": "status.users"}]}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"admins": ["a@gmail.com", "c@gmail.com"], "sre": ["b@gmail.com", "C@gmail.com", "d@gmail.com"], "contractors": ["d@gmail.com"]}}`,
+			},
+			path: "status.users",
+			want: []string{"d@gmail.com"},
+		},
+		"CombineUsersSymmetricDifference": {
+			reason: "The symmetric difference should keep users in only one of the sets",
+			args: args{
+				input:    `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Input", "functionType": "CombineUsers", "sortOrder": "Alphabetical", "userSets": {"admins": "spec.admins", "sre": "spec.sre", "contractors": "spec.contractors", "missing": "spec.missing"}, "combinations": [{"expression": "sre ^ contractors ^ missing", "toPath": "status.users"}]}`,
+				observed: `{"apiVersion": "template.fn.crossplane.io/v1beta1", "kind": "Output", "spec": {"admins": ["a@gmail.com", "c@gmail.com"], "sre": ["b@gmail.com", "C@gmail.com", "d@gmail.com"], "contractors": ["d@gmail.com"]}}`,
+			},
+			path: "status.users",
+			want: []string{"C@gmail.com", "b@gmail.com"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			clients := client.NewPool(func(cfg client.Config) client.KeycloakClientInterface {
+				return &KeyCloakMockClient{config: cfg}
+			})
+			f := &Function{log: logging.NewNopLogger(), connections: client.NewRegistry(), clients: clients, now: time.Now}
+			req := &fnv1.RunFunctionRequest{
+				Input:    resource.MustStructJSON(tc.args.input),
+				Observed: &fnv1.State{Composite: &fnv1.Resource{Resource: resource.MustStructJSON(tc.args.observed)}},
+			}
+
+			rsp, err := f.RunFunction(context.Background(), req)
+			if err != nil {
+				t.Fatalf("f.RunFunction(...): %v", err)
+			}
+			paved := fieldpath.Pave(rsp.GetDesired().GetComposite().GetResource().AsMap())
+			got, err := paved.GetStringArray(tc.path)
+			if err != nil {
+				t.Fatalf("cannot get %s from the desired XR: %v", tc.path, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestEvalSetExpression(t *testing.T) {
+	sets := map[string][]string{"a": {"x"}, "b": {"y"}}
+
+	cases := map[string]struct {
+		reason string
+		expr   string
+		want   error
+	}{
+		"UnknownSet": {
+			reason: "Names missing from the user sets should be rejected",
+			expr:   "a | c",
+			want:   errors.New("unknown user set c"),
+		},
+		"MissingOperand": {
+			reason: "An expression ending with an operator should be rejected",
+			expr:   "a |",
+			want:   errors.New("expression ends early"),
+		},
+		"UnbalancedParentheses": {
+			reason: "A group that is not closed should be rejected",
+			expr:   "(a | b",
+			want:   errors.New("missing closing parenthesis"),
+		},
+		"TrailingTokens": {
+			reason: "Operands not joined by an operator should be rejected",
+			expr:   "a b",
+			want:   errors.New(`unexpected "b" in expression "a b"`),
+		},
+		"UnknownCharacter": {
+			reason: "Characters that are neither names nor operators should be rejected",
+			expr:   "a + b",
+			want:   errors.New(`unexpected '+' in expression "a + b"`),
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := evalSetExpression(tc.expr, sets, func(u string) string { return u })
+			if diff := cmp.Diff(tc.want.Error(), fmt.Sprint(err)); diff != "" {
+				t.Errorf("%s\nevalSetExpression(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestValidateSetName(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		name   string
+		want   string
+	}{
+		"Valid": {
+			reason: "Names of letters, digits and underscores should be accepted",
+			name:   "platform_admins2",
+		},
+		"Hyphen": {
+			reason: "Names holding the difference operator should be rejected with the allowed characters",
+			name:   "platform-admins",
+			want:   `user set name "platform-admins" may only contain letters, digits and '_', got '-'`,
+		},
+		"Empty": {
+			reason: "An empty name should be rejected",
+			want:   "user set name must not be empty",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var got string
+			if err := validateSetName(tc.name); err != nil {
+				got = err.Error()
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nvalidateSetName(...): -want error, +got error:\n%s", tc.reason, diff)
 			}
 		})
 	}
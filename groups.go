@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/crossplane/function-keycloak/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/samber/lo"
+)
+
+// parseGroupTemplates parses the group templates of a group list. Templates
+// fail on fields the XR does not hold rather than render "<no value>".
+func parseGroupTemplates(patterns []string) ([]*template.Template, error) {
+	templates := make([]*template.Template, 0, len(patterns))
+	for _, p := range patterns {
+		t, err := template.New(p).Option("missingkey=error").Parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group template %q: %w", p, err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// groupNames returns the groups of the group list other than those at its
+// FromCompositeField: the literal groups, the rendered templates and the
+// groups of its sources, in that order, each listed once. Sources reading the
+// pipeline Context read it from req.
+func groupNames(req *fnv1.RunFunctionRequest, xr *fieldpath.Paved, gl v1beta1.GroupList, templates []*template.Template) ([]string, error) {
+	names := append([]string{}, gl.Groups...)
+
+	for _, t := range templates {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, xr.UnstructuredContent()); err != nil {
+			return nil, fmt.Errorf("cannot render group template %q: %w", t.Name(), err)
+		}
+		name := strings.TrimSpace(buf.String())
+		if name == "" {
+			return nil, fmt.Errorf("group template %q rendered nothing", t.Name())
+		}
+		names = append(names, name)
+	}
+
+	for _, src := range gl.Sources {
+		sourced, err := sourceGroupNames(req, xr, src)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, sourced...)
+	}
+	return lo.Uniq(names), nil
+}
+
+// sourceGroupNames returns the groups held at a source's field or context
+// key, reading the NameField of each object when it holds objects.
+func sourceGroupNames(req *fnv1.RunFunctionRequest, xr *fieldpath.Paved, src v1beta1.GroupSource) ([]string, error) {
+	from := src.FromCompositeField
+	var (
+		v   any
+		err error
+	)
+	switch {
+	case src.FromContextKey != "" && src.FromCompositeField != "":
+		return nil, fmt.Errorf("group source %s reads both a composite field and context key %s", src.FromCompositeField, src.FromContextKey)
+	case src.FromContextKey != "":
+		from = "context key " + src.FromContextKey
+		v, err = contextValue(req, src.FromContextKey)
+	default:
+		v, err = xr.GetValue(src.FromCompositeField)
+	}
+	if err != nil {
+		return nil, err
+	}
+	items, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an array", from)
+	}
+
+	names := make([]string, 0, len(items))
+	for i, item := range items {
+		switch item := item.(type) {
+		case string:
+			names = append(names, item)
+		case map[string]any:
+			if src.NameField == "" {
+				return nil, fmt.Errorf("%s[%d]: nameField is required to read groups from objects", from, i)
+			}
+			name, err := fieldpath.Pave(item).GetString(src.NameField)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d]: %w", from, i, err)
+			}
+			names = append(names, name)
+		default:
+			return nil, fmt.Errorf("%s[%d]: not a string or an object", from, i)
+		}
+	}
+	return names, nil
+}
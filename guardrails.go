@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/crossplane/function-keycloak/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
+)
+
+// guardrailViolation returns why output must not replace the observed users,
+// or an empty string when it may. Users are compared as dedupeKey does, so
+// with ignoreEmailCase an email changing case is not a removal.
+func guardrailViolation(g *v1beta1.Guardrails, observed, output []any, ignoreEmailCase bool) string {
+	if g == nil {
+		return ""
+	}
+	if g.MinMembers != nil && len(output) < *g.MinMembers {
+		return fmt.Sprintf("found %d users, fewer than the minimum of %d", len(output), *g.MinMembers)
+	}
+	if g.RefuseEmpty && len(observed) > 0 && len(output) == 0 {
+		return fmt.Sprintf("found no users to replace the %d observed ones", len(observed))
+	}
+	if g.MaxRemovalPercent != nil && len(observed) > 0 {
+		kept := make(map[string]bool, len(output))
+		for _, v := range output {
+			kept[dedupeKey(v, ignoreEmailCase)] = true
+		}
+		removed := 0
+		for _, v := range observed {
+			if !kept[dedupeKey(v, ignoreEmailCase)] {
+				removed++
+			}
+		}
+		if removed*100 > *g.MaxRemovalPercent*len(observed) {
+			return fmt.Sprintf("would remove %d of %d observed users, more than the maximum of %d%%", removed, len(observed), *g.MaxRemovalPercent)
+		}
+	}
+	return ""
+}
+
+// memberKey identifies a written user: the string itself, or the id of a user
+// object. Objects without an id are compared as a whole.
+func memberKey(v any) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case map[string]any:
+		if id, ok := t["id"].(string); ok {
+			return id
+		}
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// observedUsers returns the users the XR holds at path, and whether it holds
+// any value there.
+func observedUsers(xr *fieldpath.Paved, path string) ([]any, bool) {
+	v, err := xr.GetValue(path)
+	if err != nil {
+		return nil, false
+	}
+	users, _ := v.([]any)
+	return users, true
+}
+
+// guardrailsOverridden reports whether the XR turns the guardrails off.
+func guardrailsOverridden(xr *fieldpath.Paved) bool {
+	v, _ := xr.GetString(fmt.Sprintf("metadata.annotations[%s]", v1beta1.AnnotationOverrideGuardrails))
+	return v == "true"
+}
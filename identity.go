@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crossplane/function-keycloak/client"
+	"github.com/crossplane/function-keycloak/input/v1beta1"
+)
+
+// selectIdentity returns the value the selector picks from the user, and
+// whether the user has one.
+func selectIdentity(u client.User, s v1beta1.IdentitySelector) (string, bool) {
+	var v string
+	switch s.Type {
+	case v1beta1.IdentityTypeUsername:
+		v = u.Username
+	case v1beta1.IdentityTypeID:
+		v = u.ID
+	case v1beta1.IdentityTypeAttribute:
+		if values := u.Attributes[s.Attribute]; len(values) > 0 {
+			v = values[0]
+		}
+	case v1beta1.IdentityTypeFederatedIdentity:
+		v = u.FederatedIdentities[s.IdentityProvider]
+	default:
+		v = u.Email
+	}
+	return v, v != ""
+}
+
+// identities maps users to the identity selected by id, applying its policy
+// for users missing the value. It returns warnings for placeholders written.
+func identities(users []client.User, id *v1beta1.Identity) ([]string, []string, error) {
+	if id == nil {
+		id = &v1beta1.Identity{}
+	}
+	placeholder := id.Placeholder
+	if placeholder == "" {
+		placeholder = v1beta1.DefaultIdentityPlaceholder
+	}
+
+	out := []string{}
+	warnings := []string{}
+	for _, u := range users {
+		if v, ok := selectIdentity(u, id.IdentitySelector); ok {
+			out = append(out, v)
+			continue
+		}
+
+		switch id.MissingPolicy {
+		case v1beta1.MissingIdentityPolicySkip:
+		case v1beta1.MissingIdentityPolicyFail:
+			return nil, nil, fmt.Errorf("user %s has no %s", userLabel(u), identityLabel(id.IdentitySelector))
+		case v1beta1.MissingIdentityPolicyFallback:
+			if id.Fallback == nil {
+				return nil, nil, fmt.Errorf("missingPolicy %s requires a fallback", v1beta1.MissingIdentityPolicyFallback)
+			}
+			if v, ok := selectIdentity(u, *id.Fallback); ok {
+				out = append(out, v)
+			}
+		default:
+			out = append(out, placeholder)
+			warnings = append(warnings, fmt.Sprintf("user %s has no %s, writing %q", userLabel(u), identityLabel(id.IdentitySelector), placeholder))
+		}
+	}
+	return out, warnings, nil
+}
+
+// wantsFederatedIdentities reports whether id reads identity provider links.
+func wantsFederatedIdentities(id *v1beta1.Identity) bool {
+	if id == nil {
+		return false
+	}
+	if id.Type == v1beta1.IdentityTypeFederatedIdentity {
+		return true
+	}
+	return id.MissingPolicy == v1beta1.MissingIdentityPolicyFallback && id.Fallback != nil &&
+		id.Fallback.Type == v1beta1.IdentityTypeFederatedIdentity
+}
+
+func identityLabel(s v1beta1.IdentitySelector) string {
+	switch s.Type {
+	case v1beta1.IdentityTypeAttribute:
+		return fmt.Sprintf("attribute %s", s.Attribute)
+	case v1beta1.IdentityTypeFederatedIdentity:
+		return fmt.Sprintf("link to identity provider %s", s.IdentityProvider)
+	case "":
+		return "email"
+	default:
+		return string(s.Type)
+	}
+}
+
+// userLabel names a user in messages.
+func userLabel(u client.User) string {
+	if u.Username != "" {
+		return u.Username
+	}
+	return u.ID
+}
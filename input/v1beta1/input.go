@@ -11,10 +11,20 @@ import (
 type FunctionType string
 
 const (
-	FunctionTypeFetchUser   FunctionType = "FetchUser"
-	FunctionTypeDedupeUsers FunctionType = "DedupeUsers"
+	FunctionTypeFetchUser              FunctionType = "FetchUser"
+	FunctionTypeDedupeUsers            FunctionType = "DedupeUsers"
+	FunctionTypeCombineUsers           FunctionType = "CombineUsers"
+	FunctionTypeFetchRealmRoleUsers    FunctionType = "FetchRealmRoleUsers"
+	FunctionTypeFetchClientRoleUsers   FunctionType = "FetchClientRoleUsers"
+	FunctionTypeFetchOrganizationUsers FunctionType = "FetchOrganizationUsers"
+	FunctionTypeFetchUserMemberships   FunctionType = "FetchUserMemberships"
+	FunctionTypeValidateUsers          FunctionType = "ValidateUsers"
 )
 
+// DefaultCredentialsName is the name of the step credentials the Keycloak
+// connection is read from when CredentialsName is not set.
+const DefaultCredentialsName = "keycloak"
+
 // This isn't a custom resource, in the sense that we never install its CRD.
 // It is a KRM-like object, so we generate a CRD to describe its schema.
 
@@ -31,17 +41,467 @@ type Input struct {
 
 	FunctionType FunctionType `json:"functionType"`
 
-	GroupList   `json:"groupList,omitempty"`
+	// CredentialsName is the name of the step credentials holding the
+	// Keycloak url, realm, clientId and clientSecret. Settings missing from
+	// the credentials fall back to the selected Connection. Defaults to
+	// "keycloak".
+	CredentialsName string `json:"credentialsName,omitempty"`
+
+	// Connection selects a named connection registered with the function.
+	// Settings from the step credentials override the connection's own.
+	// Defaults to the connection built from the environment.
+	Connection string `json:"connection,omitempty"`
+
+	// Environment reads the connection's url, realm and clientId from the
+	// EnvironmentConfig data Crossplane puts in the pipeline Context. They
+	// take precedence over the connection and the step credentials, while
+	// the client secret still comes from those.
+	Environment *EnvironmentConnection `json:"environment,omitempty"`
+
+	// Realm to look users up in. Defaults to the realm the connection logs
+	// in to.
+	Realm string `json:"realm,omitempty"`
+
+	// RealmFromCompositeField is a fieldpath in the observed XR that, when
+	// set, overrides Realm.
+	RealmFromCompositeField string `json:"realmFromCompositeField,omitempty"`
+
+	// Timeout bounds the time the step waits for Keycloak. The deadline of
+	// the function call still applies when it is shorter. Must be positive.
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	GroupList `json:"groupList,omitempty"`
+
+	// RoleList selects the roles FetchRealmRoleUsers and
+	// FetchClientRoleUsers look up.
+	RoleList RoleList `json:"roleList,omitempty"`
+
+	// OrganizationList selects the organizations FetchOrganizationUsers
+	// looks up.
+	OrganizationList OrganizationList `json:"organizationList,omitempty"`
+
+	// UserList selects the users FetchUserMemberships and ValidateUsers
+	// look up.
+	UserList UserList `json:"userList,omitempty"`
+
+	// Validation tunes how ValidateUsers handles users that do not exist
+	// or are disabled.
+	Validation *Validation `json:"validation,omitempty"`
+
 	OutputField string `json:"outputField,omitempty"`
 
+	// OutputContextKey is a key in the pipeline Context that FetchUser
+	// writes the users to, for later steps to read without the users
+	// landing in the XR. OutputField may be left unset when it is given.
+	OutputContextKey string `json:"outputContextKey,omitempty"`
+
+	// OutputFormat of the users written to OutputField. Strings writes the
+	// selected identity of each user, Objects writes one object per user
+	// with the fields chosen in UserObject. Defaults to Strings.
+	// +kubebuilder:validation:Enum=Strings;Objects
+	OutputFormat OutputFormat `json:"outputFormat,omitempty"`
+
+	// UserObject selects the fields written when OutputFormat is Objects.
+	UserObject *UserObject `json:"userObject,omitempty"`
+
+	// SortOrder of the written users. Input keeps the order users were
+	// found in, which is the order of the groups for FetchUser and of the
+	// priorities for DedupeUsers. Alphabetical and CaseInsensitive sort by
+	// the written value, or by the username, email or id of user objects.
+	// Defaults to Input.
+	// +kubebuilder:validation:Enum=Input;Alphabetical;CaseInsensitive
+	SortOrder SortOrder `json:"sortOrder,omitempty"`
+
+	// IgnoreEmailCase treats users whose emails differ only in case as the
+	// same user, keeping the first one found.
+	IgnoreEmailCase bool `json:"ignoreEmailCase,omitempty"`
+
+	// Guardrails keep the observed value of OutputField when the users
+	// found look like the result of a broken Keycloak rather than a real
+	// change. Annotate the XR with keycloak.fn.crossplane.io/override-guardrails
+	// set to "true" to write the users anyway.
+	Guardrails *Guardrails `json:"guardrails,omitempty"`
+
+	// ChangeReport tunes how the users added to and removed from each
+	// written path are reported.
+	ChangeReport *ChangeReport `json:"changeReport,omitempty"`
+
 	GroupsPriority []TransformData `json:"groupsPriority,omitempty"`
+
+	// UserSets names the user lists CombineUsers reads, mapping each name
+	// to a fieldpath in the XR. Names may only hold letters, digits and '_'.
+	UserSets map[string]string `json:"userSets,omitempty"`
+
+	// Combinations are the set expressions CombineUsers evaluates.
+	Combinations []Combination `json:"combinations,omitempty"`
+}
+
+type OutputFormat string
+
+const (
+	OutputFormatStrings OutputFormat = "Strings"
+	OutputFormatObjects OutputFormat = "Objects"
+)
+
+type SortOrder string
+
+const (
+	SortOrderInput           SortOrder = "Input"
+	SortOrderAlphabetical    SortOrder = "Alphabetical"
+	SortOrderCaseInsensitive SortOrder = "CaseInsensitive"
+)
+
+// +kubebuilder:validation:Enum=id;username;email;firstName;lastName;enabled;emailVerified;groups
+type UserField string
+
+const (
+	UserFieldID            UserField = "id"
+	UserFieldUsername      UserField = "username"
+	UserFieldEmail         UserField = "email"
+	UserFieldFirstName     UserField = "firstName"
+	UserFieldLastName      UserField = "lastName"
+	UserFieldEnabled       UserField = "enabled"
+	UserFieldEmailVerified UserField = "emailVerified"
+	UserFieldGroups        UserField = "groups"
+)
+
+// DefaultUserFields are written when UserObject.Fields is empty.
+var DefaultUserFields = []UserField{UserFieldID, UserFieldUsername, UserFieldEmail}
+
+type UserObject struct {
+	// Fields copied into each user object. groups lists the paths of the
+	// groups the user was found through. Defaults to id, username and email.
+	Fields []UserField `json:"fields,omitempty"`
+
+	// Attributes lists the user attributes copied into the attributes map of
+	// each user object.
+	Attributes []string `json:"attributes,omitempty"`
+}
+
+// AnnotationOverrideGuardrails on an XR set to "true" turns the guardrails of
+// its FetchUser steps off.
+const AnnotationOverrideGuardrails = "keycloak.fn.crossplane.io/override-guardrails"
+
+// EnvironmentConnection names the fieldpaths of the environment holding
+// connection settings. Settings without a fieldpath are left as they are.
+type EnvironmentConnection struct {
+	// UrlField is a fieldpath in the environment holding the Keycloak url,
+	// such as "keycloak.url".
+	UrlField string `json:"urlField,omitempty"`
+
+	// RealmField is a fieldpath in the environment holding the realm the
+	// client logs in to.
+	RealmField string `json:"realmField,omitempty"`
+
+	// ClientIDField is a fieldpath in the environment holding the clientId
+	// the client logs in as.
+	ClientIDField string `json:"clientIdField,omitempty"`
+}
+
+type Guardrails struct {
+	// MinMembers is the fewest users a step may write.
+	// +kubebuilder:validation:Minimum=0
+	MinMembers *int `json:"minMembers,omitempty"`
+
+	// MaxRemovalPercent is the largest share of the observed users a step
+	// may remove at once.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	MaxRemovalPercent *int `json:"maxRemovalPercent,omitempty"`
+
+	// RefuseEmpty keeps a non-empty observed value instead of writing an
+	// empty list.
+	RefuseEmpty bool `json:"refuseEmpty,omitempty"`
+}
+
+// DefaultChangeReportMaxListed is how many added and removed users are named
+// when ChangeReport.MaxListed is not set.
+const DefaultChangeReportMaxListed = 20
+
+type ChangeReport struct {
+	// MaxListed caps how many added and how many removed users are named in
+	// the results. Zero only reports the counts. Defaults to 20.
+	// +kubebuilder:validation:Minimum=0
+	MaxListed *int `json:"maxListed,omitempty"`
+
+	// SummaryField is a fieldpath in the XR, such as
+	// status.membershipChanges, holding an object that maps each written
+	// path to the added, removed and unchanged user counts of its last run
+	// and the time its users last changed.
+	SummaryField string `json:"summaryField,omitempty"`
 }
 
 type GroupList struct {
+	// FromCompositeField is a fieldpath in the observed XR holding the groups
+	// to look up. Groups are referenced by full path such as
+	// "/engineering/platform/admins", by ID, or by top-level group name.
+	// It may be left unset when groups come from the other fields below.
+	FromCompositeField string `json:"fromCompositeField,omitempty"`
+
+	// Groups lists groups to look up in the Input itself.
+	Groups []string `json:"groups,omitempty"`
+
+	// Templates are Go templates rendered against the observed XR, each
+	// giving one group to look up, such as
+	// "{{ .metadata.labels.team }}-admins". A template referencing a
+	// field the XR does not hold yet leaves the step waiting like a
+	// missing FromCompositeField does.
+	Templates []string `json:"templates,omitempty"`
+
+	// Sources are further fields of the observed XR to read groups from.
+	// The groups of every source are merged, each looked up once.
+	Sources []GroupSource `json:"sources,omitempty"`
+
+	// IncludeSubgroupMembers also returns the members of every descendant of
+	// the listed groups.
+	IncludeSubgroupMembers bool `json:"includeSubgroupMembers,omitempty"`
+
+	// Selectors pick further groups by name pattern or attribute through
+	// Keycloak's group search, so the groups need not be listed in the XR.
+	Selectors []GroupSelector `json:"selectors,omitempty"`
+
+	// MissingGroupPolicy decides what happens when a listed group does not
+	// exist: Fail, Warn or Ignore, which also silences the warnings about
+	// selectors matching no group. The value is matched regardless of case.
+	// Defaults to Fail.
+	MissingGroupPolicy MissingGroupPolicy `json:"missingGroupPolicy,omitempty"`
+
+	// Identity selects which user field is written for each member.
+	// Defaults to the email, with "None" for users without one.
+	Identity *Identity `json:"identity,omitempty"`
+
+	// Filter leaves out members that do not match it.
+	Filter *UserFilter `json:"filter,omitempty"`
+}
+
+// GroupSource is a field of the observed XR, or a key of the pipeline Context,
+// holding groups. Exactly one of FromCompositeField and FromContextKey must be
+// set.
+type GroupSource struct {
+	// FromCompositeField is a fieldpath in the observed XR holding an array
+	// of group references, or of objects holding one at NameField.
 	FromCompositeField string `json:"fromCompositeField,omitempty"`
+
+	// FromContextKey is a key in the pipeline Context holding an array of
+	// group references, or of objects holding one at NameField.
+	FromContextKey string `json:"fromContextKey,omitempty"`
+
+	// NameField is the fieldpath of the group reference within each object
+	// of the array, such as "spec.groupName".
+	NameField string `json:"nameField,omitempty"`
+}
+
+// GroupSelector picks groups by pattern or attribute. A group must match every
+// field set, and at least one of them must be.
+type GroupSelector struct {
+	// Glob matches group names, such as "team-*-admins". Patterns starting
+	// with "/" match full group paths, such as "/teams/*/admins". The
+	// last path segment must hold some text other than wildcards, which
+	// Keycloak is searched for.
+	Glob string `json:"glob,omitempty"`
+
+	// Regex matches group names, or full group paths when it starts with
+	// "^/". Like globs, it must hold some literal text to search for.
+	Regex string `json:"regex,omitempty"`
+
+	// Attributes maps group attributes to the value a group must hold.
+	// They are searched for with Keycloak's attribute query.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// UserFilter selects the users written. Users must match every condition set.
+type UserFilter struct {
+	// EnabledOnly leaves out disabled users.
+	EnabledOnly bool `json:"enabledOnly,omitempty"`
+
+	// EmailVerifiedOnly leaves out users whose email is not verified.
+	EmailVerifiedOnly bool `json:"emailVerifiedOnly,omitempty"`
+
+	// ExcludeServiceAccounts leaves out the service account users of
+	// clients.
+	ExcludeServiceAccounts bool `json:"excludeServiceAccounts,omitempty"`
+
+	// Attributes maps user attributes to a value the user must hold for
+	// each of them.
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// AllowedEmailDomains, when set, leaves out users whose email is not in
+	// one of the domains or their subdomains, as well as users without an
+	// email.
+	AllowedEmailDomains []string `json:"allowedEmailDomains,omitempty"`
+
+	// DeniedEmailDomains leaves out users whose email is in one of the
+	// domains or their subdomains.
+	DeniedEmailDomains []string `json:"deniedEmailDomains,omitempty"`
+}
+
+type RoleList struct {
+	// FromCompositeField is a fieldpath in the observed XR holding the names
+	// of the roles to look up.
+	FromCompositeField string `json:"fromCompositeField,omitempty"`
+
+	// ClientID is the clientId of the client whose roles
+	// FetchClientRoleUsers looks up.
+	ClientID string `json:"clientId,omitempty"`
+
+	// ExpandComposites also returns the users holding a composite role that
+	// includes a listed role. Composite realm roles and composite roles of
+	// the client are considered.
+	ExpandComposites bool `json:"expandComposites,omitempty"`
+
+	// IncludeGroupMembers also returns the members of the groups holding a
+	// listed role, and of their subgroups, which inherit it.
+	IncludeGroupMembers bool `json:"includeGroupMembers,omitempty"`
+
+	// Identity selects which user field is written for each user.
+	// Defaults to the email, with "None" for users without one.
+	Identity *Identity `json:"identity,omitempty"`
+}
+
+type OrganizationList struct {
+	// FromCompositeField is a fieldpath in the observed XR holding the ID,
+	// alias or name of the organizations to look up.
+	FromCompositeField string `json:"fromCompositeField,omitempty"`
+
+	// MembershipType only returns the members of that type. Managed members
+	// are owned by the organization, Unmanaged ones joined it with an
+	// existing realm account. Defaults to all members.
+	// +kubebuilder:validation:Enum=Managed;Unmanaged
+	MembershipType MembershipType `json:"membershipType,omitempty"`
+
+	// DomainsField is a fieldpath in the XR the domains of the
+	// organizations are written to, when set.
+	DomainsField string `json:"domainsField,omitempty"`
+
+	// Identity selects which user field is written for each user.
+	// Defaults to the email, with "None" for users without one.
+	Identity *Identity `json:"identity,omitempty"`
+}
+
+type UserList struct {
+	// FromCompositeField is a fieldpath in the observed XR holding the ID,
+	// username or email of the users to look up.
+	FromCompositeField string `json:"fromCompositeField,omitempty"`
+
+	// ClientIDs are the clientIds of the clients whose effective roles are
+	// written along with the realm roles.
+	ClientIDs []string `json:"clientIds,omitempty"`
+}
+
+type Validation struct {
+	// Mode is Condition to set the UsersValid condition of the XR to False,
+	// listing the unknown users, or Filter to write the known users to
+	// OutputField and emit a warning for the others. Defaults to Condition.
+	// +kubebuilder:validation:Enum=Condition;Filter
+	Mode ValidationMode `json:"mode,omitempty"`
+}
+
+type ValidationMode string
+
+const (
+	ValidationModeCondition ValidationMode = "Condition"
+	ValidationModeFilter    ValidationMode = "Filter"
+)
+
+type MembershipType string
+
+const (
+	MembershipTypeManaged   MembershipType = "Managed"
+	MembershipTypeUnmanaged MembershipType = "Unmanaged"
+)
+
+type IdentityType string
+
+const (
+	IdentityTypeEmail             IdentityType = "Email"
+	IdentityTypeUsername          IdentityType = "Username"
+	IdentityTypeID                IdentityType = "ID"
+	IdentityTypeAttribute         IdentityType = "Attribute"
+	IdentityTypeFederatedIdentity IdentityType = "FederatedIdentity"
+)
+
+type MissingGroupPolicy string
+
+const (
+	// MissingGroupPolicyFail fails the step.
+	MissingGroupPolicyFail MissingGroupPolicy = "Fail"
+	// MissingGroupPolicyWarn leaves the group out and emits a warning.
+	MissingGroupPolicyWarn MissingGroupPolicy = "Warn"
+	// MissingGroupPolicyIgnore silently leaves the group out.
+	MissingGroupPolicyIgnore MissingGroupPolicy = "Ignore"
+)
+
+type MissingIdentityPolicy string
+
+const (
+	// MissingIdentityPolicySkip leaves users without the field out.
+	MissingIdentityPolicySkip MissingIdentityPolicy = "Skip"
+	// MissingIdentityPolicyFail fails the step.
+	MissingIdentityPolicyFail MissingIdentityPolicy = "Fail"
+	// MissingIdentityPolicyFallback uses the Fallback selector instead.
+	MissingIdentityPolicyFallback MissingIdentityPolicy = "Fallback"
+	// MissingIdentityPolicyPlaceholder writes Placeholder and emits a warning.
+	MissingIdentityPolicyPlaceholder MissingIdentityPolicy = "Placeholder"
+)
+
+// DefaultIdentityPlaceholder is written for users missing the selected field
+// when no Placeholder is set.
+const DefaultIdentityPlaceholder = "None"
+
+// IdentitySelector picks a single value from a Keycloak user.
+type IdentitySelector struct {
+	// Type of the value to pick. Defaults to Email.
+	// +kubebuilder:validation:Enum=Email;Username;ID;Attribute;FederatedIdentity
+	Type IdentityType `json:"type,omitempty"`
+
+	// Attribute is the user attribute read when Type is Attribute. The
+	// first value of the attribute is used.
+	Attribute string `json:"attribute,omitempty"`
+
+	// IdentityProvider is the alias of the identity provider whose linked
+	// user name is read when Type is FederatedIdentity.
+	IdentityProvider string `json:"identityProvider,omitempty"`
+}
+
+type Identity struct {
+	IdentitySelector `json:",inline"`
+
+	// MissingPolicy decides what happens to users without the selected
+	// value. Defaults to Placeholder.
+	// +kubebuilder:validation:Enum=Skip;Fail;Fallback;Placeholder
+	MissingPolicy MissingIdentityPolicy `json:"missingPolicy,omitempty"`
+
+	// Fallback is the selector used when MissingPolicy is Fallback. Users
+	// missing both values are skipped.
+	Fallback *IdentitySelector `json:"fallback,omitempty"`
+
+	// Placeholder is written when MissingPolicy is Placeholder. Defaults to
+	// "None".
+	Placeholder string `json:"placeholder,omitempty"`
 }
 
 type TransformData struct {
-	FromPathsList []string `json:"fromPathsList"`
-	ToPath        string   `json:"toPath"`
+	FromPathsList []string `json:"fromPathsList,omitempty"`
+
+	// FromContextKeys are keys in the pipeline Context holding further user
+	// lists, read after FromPathsList.
+	FromContextKeys []string `json:"fromContextKeys,omitempty"`
+
+	ToPath string `json:"toPath,omitempty"`
+
+	// ToContextKey is a key in the pipeline Context the users are written
+	// to, along with or instead of ToPath.
+	ToContextKey string `json:"toContextKey,omitempty"`
+}
+
+type Combination struct {
+	// Expression combines the sets named in UserSets, such as
+	// "(admins | sre) - contractors". | or ∪ is the union, & or ∩ the
+	// intersection, - or − the difference and ^ or △ the symmetric
+	// difference. Intersection binds tighter than the other operators,
+	// which apply left to right. Parentheses group.
+	Expression string `json:"expression"`
+
+	// ToPath is the fieldpath in the XR the result is written to.
+	ToPath string `json:"toPath"`
 }
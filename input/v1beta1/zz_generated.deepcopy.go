@@ -5,12 +5,95 @@
 package v1beta1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ChangeReport) DeepCopyInto(out *ChangeReport) {
+	*out = *in
+	if in.MaxListed != nil {
+		in, out := &in.MaxListed, &out.MaxListed
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ChangeReport.
+func (in *ChangeReport) DeepCopy() *ChangeReport {
+	if in == nil {
+		return nil
+	}
+	out := new(ChangeReport)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Combination) DeepCopyInto(out *Combination) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Combination.
+func (in *Combination) DeepCopy() *Combination {
+	if in == nil {
+		return nil
+	}
+	out := new(Combination)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EnvironmentConnection) DeepCopyInto(out *EnvironmentConnection) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EnvironmentConnection.
+func (in *EnvironmentConnection) DeepCopy() *EnvironmentConnection {
+	if in == nil {
+		return nil
+	}
+	out := new(EnvironmentConnection)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GroupList) DeepCopyInto(out *GroupList) {
 	*out = *in
+	if in.Groups != nil {
+		in, out := &in.Groups, &out.Groups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Templates != nil {
+		in, out := &in.Templates, &out.Templates
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Sources != nil {
+		in, out := &in.Sources, &out.Sources
+		*out = make([]GroupSource, len(*in))
+		copy(*out, *in)
+	}
+	if in.Selectors != nil {
+		in, out := &in.Selectors, &out.Selectors
+		*out = make([]GroupSelector, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Identity != nil {
+		in, out := &in.Identity, &out.Identity
+		*out = new(Identity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Filter != nil {
+		in, out := &in.Filter, &out.Filter
+		*out = new(UserFilter)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GroupList.
@@ -23,12 +106,143 @@ func (in *GroupList) DeepCopy() *GroupList {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GroupSelector) DeepCopyInto(out *GroupSelector) {
+	*out = *in
+	if in.Attributes != nil {
+		in, out := &in.Attributes, &out.Attributes
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GroupSelector.
+func (in *GroupSelector) DeepCopy() *GroupSelector {
+	if in == nil {
+		return nil
+	}
+	out := new(GroupSelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GroupSource) DeepCopyInto(out *GroupSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GroupSource.
+func (in *GroupSource) DeepCopy() *GroupSource {
+	if in == nil {
+		return nil
+	}
+	out := new(GroupSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Guardrails) DeepCopyInto(out *Guardrails) {
+	*out = *in
+	if in.MinMembers != nil {
+		in, out := &in.MinMembers, &out.MinMembers
+		*out = new(int)
+		**out = **in
+	}
+	if in.MaxRemovalPercent != nil {
+		in, out := &in.MaxRemovalPercent, &out.MaxRemovalPercent
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Guardrails.
+func (in *Guardrails) DeepCopy() *Guardrails {
+	if in == nil {
+		return nil
+	}
+	out := new(Guardrails)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Identity) DeepCopyInto(out *Identity) {
+	*out = *in
+	out.IdentitySelector = in.IdentitySelector
+	if in.Fallback != nil {
+		in, out := &in.Fallback, &out.Fallback
+		*out = new(IdentitySelector)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Identity.
+func (in *Identity) DeepCopy() *Identity {
+	if in == nil {
+		return nil
+	}
+	out := new(Identity)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IdentitySelector) DeepCopyInto(out *IdentitySelector) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IdentitySelector.
+func (in *IdentitySelector) DeepCopy() *IdentitySelector {
+	if in == nil {
+		return nil
+	}
+	out := new(IdentitySelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Input) DeepCopyInto(out *Input) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.GroupList = in.GroupList
+	if in.Environment != nil {
+		in, out := &in.Environment, &out.Environment
+		*out = new(EnvironmentConnection)
+		**out = **in
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	in.GroupList.DeepCopyInto(&out.GroupList)
+	in.RoleList.DeepCopyInto(&out.RoleList)
+	in.OrganizationList.DeepCopyInto(&out.OrganizationList)
+	in.UserList.DeepCopyInto(&out.UserList)
+	if in.Validation != nil {
+		in, out := &in.Validation, &out.Validation
+		*out = new(Validation)
+		**out = **in
+	}
+	if in.UserObject != nil {
+		in, out := &in.UserObject, &out.UserObject
+		*out = new(UserObject)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Guardrails != nil {
+		in, out := &in.Guardrails, &out.Guardrails
+		*out = new(Guardrails)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ChangeReport != nil {
+		in, out := &in.ChangeReport, &out.ChangeReport
+		*out = new(ChangeReport)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.GroupsPriority != nil {
 		in, out := &in.GroupsPriority, &out.GroupsPriority
 		*out = make([]TransformData, len(*in))
@@ -36,6 +250,18 @@ func (in *Input) DeepCopyInto(out *Input) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.UserSets != nil {
+		in, out := &in.UserSets, &out.UserSets
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Combinations != nil {
+		in, out := &in.Combinations, &out.Combinations
+		*out = make([]Combination, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Input.
@@ -56,6 +282,46 @@ func (in *Input) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OrganizationList) DeepCopyInto(out *OrganizationList) {
+	*out = *in
+	if in.Identity != nil {
+		in, out := &in.Identity, &out.Identity
+		*out = new(Identity)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OrganizationList.
+func (in *OrganizationList) DeepCopy() *OrganizationList {
+	if in == nil {
+		return nil
+	}
+	out := new(OrganizationList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RoleList) DeepCopyInto(out *RoleList) {
+	*out = *in
+	if in.Identity != nil {
+		in, out := &in.Identity, &out.Identity
+		*out = new(Identity)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RoleList.
+func (in *RoleList) DeepCopy() *RoleList {
+	if in == nil {
+		return nil
+	}
+	out := new(RoleList)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TransformData) DeepCopyInto(out *TransformData) {
 	*out = *in
@@ -64,6 +330,11 @@ func (in *TransformData) DeepCopyInto(out *TransformData) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.FromContextKeys != nil {
+		in, out := &in.FromContextKeys, &out.FromContextKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TransformData.
@@ -75,3 +346,95 @@ func (in *TransformData) DeepCopy() *TransformData {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UserFilter) DeepCopyInto(out *UserFilter) {
+	*out = *in
+	if in.Attributes != nil {
+		in, out := &in.Attributes, &out.Attributes
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.AllowedEmailDomains != nil {
+		in, out := &in.AllowedEmailDomains, &out.AllowedEmailDomains
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DeniedEmailDomains != nil {
+		in, out := &in.DeniedEmailDomains, &out.DeniedEmailDomains
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UserFilter.
+func (in *UserFilter) DeepCopy() *UserFilter {
+	if in == nil {
+		return nil
+	}
+	out := new(UserFilter)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UserList) DeepCopyInto(out *UserList) {
+	*out = *in
+	if in.ClientIDs != nil {
+		in, out := &in.ClientIDs, &out.ClientIDs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UserList.
+func (in *UserList) DeepCopy() *UserList {
+	if in == nil {
+		return nil
+	}
+	out := new(UserList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UserObject) DeepCopyInto(out *UserObject) {
+	*out = *in
+	if in.Fields != nil {
+		in, out := &in.Fields, &out.Fields
+		*out = make([]UserField, len(*in))
+		copy(*out, *in)
+	}
+	if in.Attributes != nil {
+		in, out := &in.Attributes, &out.Attributes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UserObject.
+func (in *UserObject) DeepCopy() *UserObject {
+	if in == nil {
+		return nil
+	}
+	out := new(UserObject)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Validation) DeepCopyInto(out *Validation) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Validation.
+func (in *Validation) DeepCopy() *Validation {
+	if in == nil {
+		return nil
+	}
+	out := new(Validation)
+	in.DeepCopyInto(out)
+	return out
+}
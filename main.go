@@ -2,7 +2,12 @@
 package main
 
 import (
+	"time"
+
 	"github.com/alecthomas/kong"
+
+	"github.com/crossplane/function-keycloak/client"
+
 	"github.com/crossplane/function-sdk-go"
 )
 
@@ -15,11 +20,34 @@ type CLI struct {
 	TLSCertsDir        string `help:"Directory containing server certs (tls.key, tls.crt) and the CA used to verify client certificates (ca.crt)" env:"TLS_SERVER_CERTS_DIR"`
 	Insecure           bool   `help:"Run without mTLS credentials. If you supply this flag --tls-server-certs-dir will be ignored."`
 	MaxRecvMessageSize int    `help:"Maximum size of received messages in MB." default:"4"`
+	Connections        string `help:"YAML file of named Keycloak connections steps can select in addition to the default one built from the environment." env:"KEYCLOAK_CONNECTIONS_FILE"`
+	PageSize           int    `help:"Number of items requested per page when listing groups and members." default:"100"`
+	MaxResults         int    `help:"Maximum number of items read from a single Keycloak listing. Listings cut off by this cap emit a warning." default:"10000"`
+	Parallelism        int    `help:"Maximum number of concurrent Keycloak requests sent for a single lookup." default:"4"`
+
+	Retries          int           `help:"Number of times a Keycloak read failing with a network error, 5xx or 429 is retried." default:"3"`
+	RetryWait        time.Duration `help:"Initial wait between retries, doubled with jitter on every attempt." default:"200ms"`
+	RetryMaxWait     time.Duration `help:"Maximum wait between retries, also caps the wait asked for by Retry-After." default:"5s"`
+	BreakerThreshold int           `help:"Number of consecutive failed Keycloak requests after which requests are stopped." default:"5"`
+	BreakerCooldown  time.Duration `help:"How long requests are stopped once the breaker threshold is reached." default:"30s"`
+	MaxStaleness     time.Duration `help:"How long past their expiry cached groups and members are still returned, with a warning, while Keycloak is unavailable. Zero disables it." default:"0s"`
 }
 
 // Run this Function.
 func (c *CLI) Run() error {
-	f, err := NewFunction(c.Debug)
+	connections, err := client.LoadRegistry(c.Connections)
+	if err != nil {
+		return err
+	}
+
+	f, err := NewFunction(c.Debug, connections,
+		client.WithPageSize(c.PageSize),
+		client.WithMaxResults(c.MaxResults),
+		client.WithParallelism(c.Parallelism),
+		client.WithRetries(c.Retries),
+		client.WithRetryWait(c.RetryWait, c.RetryMaxWait),
+		client.WithCircuitBreaker(c.BreakerThreshold, c.BreakerCooldown),
+		client.WithMaxStaleness(c.MaxStaleness))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/crossplane/function-keycloak/client"
+	"github.com/crossplane/function-keycloak/input/v1beta1"
+)
+
+// userObjects turns users into the objects written when the output format is
+// Objects. Users found through several groups are merged into one object.
+func userObjects(users []client.User, spec *v1beta1.UserObject) []any {
+	fields := v1beta1.DefaultUserFields
+	var attributes []string
+	if spec != nil {
+		if len(spec.Fields) > 0 {
+			fields = spec.Fields
+		}
+		attributes = spec.Attributes
+	}
+
+	merged := mergeUsers(users)
+	out := make([]any, 0, len(merged))
+	for _, u := range merged {
+		obj := map[string]any{}
+		for _, f := range fields {
+			switch f {
+			case v1beta1.UserFieldID:
+				obj[string(f)] = u.ID
+			case v1beta1.UserFieldUsername:
+				obj[string(f)] = u.Username
+			case v1beta1.UserFieldEmail:
+				obj[string(f)] = u.Email
+			case v1beta1.UserFieldFirstName:
+				obj[string(f)] = u.FirstName
+			case v1beta1.UserFieldLastName:
+				obj[string(f)] = u.LastName
+			case v1beta1.UserFieldEnabled:
+				obj[string(f)] = u.Enabled
+			case v1beta1.UserFieldEmailVerified:
+				obj[string(f)] = u.EmailVerified
+			case v1beta1.UserFieldGroups:
+				obj[string(f)] = toAnySlice(u.Groups)
+			}
+		}
+		if len(attributes) > 0 {
+			attrs := map[string]any{}
+			for _, a := range attributes {
+				if values, ok := u.Attributes[a]; ok {
+					attrs[a] = toAnySlice(values)
+				}
+			}
+			obj["attributes"] = attrs
+		}
+		out = append(out, obj)
+	}
+	return out
+}
+
+// membershipObject is the object FetchUserMemberships writes for a user.
+// clientRoles holds one entry per client in clientIDs.
+func membershipObject(m client.UserMemberships, clientIDs []string) map[string]any {
+	obj := map[string]any{
+		string(v1beta1.UserFieldID):       m.User.ID,
+		string(v1beta1.UserFieldUsername): m.User.Username,
+		string(v1beta1.UserFieldEmail):    m.User.Email,
+		string(v1beta1.UserFieldGroups):   toAnySlice(m.Groups),
+		"realmRoles":                      toAnySlice(m.RealmRoles),
+	}
+	if len(clientIDs) > 0 {
+		clientRoles := make(map[string]any, len(clientIDs))
+		for _, id := range clientIDs {
+			clientRoles[id] = toAnySlice(m.ClientRoles[id])
+		}
+		obj["clientRoles"] = clientRoles
+	}
+	return obj
+}
+
+// mergeUsers collapses users listed once per group into a single entry per
+// user ID, keeping the first position and collecting every group.
+func mergeUsers(users []client.User) []client.User {
+	index := map[string]int{}
+	out := []client.User{}
+	for _, u := range users {
+		if i, ok := index[u.ID]; ok {
+			out[i].Groups = append(out[i].Groups, u.Groups...)
+			continue
+		}
+		index[u.ID] = len(out)
+		u.Groups = append([]string{}, u.Groups...)
+		out = append(out, u)
+	}
+	return out
+}
+
+// arrangeUsers drops repeated users, keeping the first one, and sorts the
+// rest in the order asked for by in.
+func arrangeUsers(users []any, in *v1beta1.Input) []any {
+	seen := map[string]bool{}
+	out := make([]any, 0, len(users))
+	for _, u := range users {
+		key := dedupeKey(u, in.IgnoreEmailCase)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, u)
+	}
+
+	switch in.SortOrder {
+	case v1beta1.SortOrderAlphabetical:
+		slices.SortStableFunc(out, func(a, b any) int {
+			return strings.Compare(memberLabel(a), memberLabel(b))
+		})
+	case v1beta1.SortOrderCaseInsensitive:
+		slices.SortStableFunc(out, func(a, b any) int {
+			la, lb := memberLabel(a), memberLabel(b)
+			if c := strings.Compare(strings.ToLower(la), strings.ToLower(lb)); c != 0 {
+				return c
+			}
+			return strings.Compare(la, lb)
+		})
+	}
+	return out
+}
+
+// dedupeKey identifies a user when dropping repeated ones. With
+// ignoreEmailCase, emails are compared in lower case.
+func dedupeKey(u any, ignoreEmailCase bool) string {
+	if ignoreEmailCase {
+		switch v := u.(type) {
+		case string:
+			if strings.Contains(v, "@") {
+				return strings.ToLower(v)
+			}
+		case map[string]any:
+			if email, ok := v[string(v1beta1.UserFieldEmail)].(string); ok && email != "" {
+				return strings.ToLower(email)
+			}
+		}
+	}
+	return memberKey(u)
+}
+
+func toAnySlice(values []string) []any {
+	out := make([]any, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crossplane/function-keycloak/client"
+)
+
+// partitionUsers splits users into the ones found enabled in Keycloak and the
+// others, each described along with why it is unknown.
+func partitionUsers(users []string, found *client.UsersResult) (known, unknown []string) {
+	known = []string{}
+	for _, u := range users {
+		user, ok := found.Users[u]
+		switch {
+		case !ok:
+			unknown = append(unknown, fmt.Sprintf("%s (not found)", u))
+		case !user.Enabled:
+			unknown = append(unknown, fmt.Sprintf("%s (disabled)", u))
+		default:
+			known = append(known, u)
+		}
+	}
+	return known, unknown
+}